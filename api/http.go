@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
 	"net/http"
 	"net/url"
 
@@ -78,23 +76,14 @@ func (api *httpAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if contentType == nQuadsMime {
-			reader := bufio.NewReader(r.Body)
-			var err error
-			var line string
-			quads := make([]*rdf.Quad, 0)
-			for err != nil {
-				line, err = reader.ReadString('\n')
-				if line != "" {
-					quads = append(quads, rdf.ParseQuad(line))
-				}
-			}
-			if (err != nil && err != io.EOF) || len(quads) == 0 {
+			dataset, err := ld.ParseNQuadsFrom(r.Body)
+			if err != nil {
 				w.WriteHeader(400)
 				w.Write([]byte(err.Error()))
 				return
 			}
 
-			err = api.store.Set(node, quads)
+			err = api.store.SetRDFDataset(node, dataset)
 			if err != nil {
 				w.WriteHeader(500)
 				w.Write([]byte(err.Error()))
@@ -1,8 +1,9 @@
 package styx
 
 import (
-	"fmt"
+	"context"
 	"sort"
+	"strings"
 
 	badger "github.com/dgraph-io/badger/v2"
 	rdf "github.com/underlay/go-rdfjs"
@@ -10,10 +11,13 @@ import (
 
 // NewIterator populates, scores, sorts, and connects a new constraint graph
 func newIterator(
+	ctx context.Context,
 	query []*rdf.Quad,
 	domain []rdf.Term,
 	index []rdf.Term,
 	tag TagScheme,
+	prefixes *Prefixes,
+	score ScoreFunction,
 	txn *badger.Txn,
 	dictionary Dictionary,
 ) (iter *Iterator, err error) {
@@ -29,9 +33,12 @@ func newIterator(
 		constants:  make([]*constraint, 0),
 		variables:  make([]*variable, len(domain)),
 		ids:        make(map[string]int, len(domain)),
-		unary:      newUnaryCache(),
-		binary:     newBinaryCache(),
+		unary:      newUnaryCache(prefixes.Unary),
+		binary:     newBinaryCache(prefixes.Binary),
+		duplicates: map[int]int{},
+		ctx:        ctx,
 		tag:        tag,
+		prefixes:   prefixes,
 		txn:        txn,
 		dictionary: dictionary,
 	}
@@ -48,7 +55,16 @@ func newIterator(
 			return nil, ErrInvalidDomain
 		}
 
+		if !validLabel(node.Value()) {
+			return nil, ErrInvalidLabel
+		}
+
+		// A repeated term would leave the variable at its second index without constraints
 		value := node.String()
+		if _, has := iter.ids[value]; has {
+			return nil, ErrInvalidDomain
+		}
+
 		iter.variables[i] = &variable{node: node}
 		iter.ids[value] = i
 	}
@@ -59,11 +75,62 @@ func newIterator(
 		return
 	}
 
+	// Validate every quad before reading any counts, so that an invalid query
+	// is an error even when one of its constants makes it empty
+	used := make(map[string]bool, len(domain))
+	for _, quad := range query {
+		if quad.Graph().TermType() != rdf.DefaultGraphType {
+			continue
+		}
+
+		degree := 0
+		for p := 0; p < 3; p++ {
+			if t := quad[p].TermType(); t == rdf.VariableType || t == rdf.BlankNodeType {
+				if !validLabel(quad[p].Value()) {
+					return nil, ErrInvalidLabel
+				}
+				used[quad[p].String()] = true
+				degree++
+			}
+		}
+
+		// Triples without constant terms are only supported for three distinct variables,
+		// since a repeated one would need a major index check like the z-degree constraints
+		if degree == 3 && (quad[0].Equal(quad[1]) || quad[1].Equal(quad[2]) || quad[2].Equal(quad[0])) {
+			return nil, ErrUnboundTriple
+		}
+	}
+
+	// Make sure that every node in the domain
+	// actually occurs in the graph
+	for _, node := range domain {
+		if !used[node.String()] {
+			return nil, ErrInvalidDomain
+		}
+	}
+
+	// Structurally identical quads would only add redundant constraints
+	// (inflating their variables' norms and doubling the cursor work),
+	// so we record them as duplicates of their first occurrence and skip them.
+	quads := make(map[string]int, len(query))
 	for i, quad := range query {
 		if quad.Graph().TermType() != rdf.DefaultGraphType {
 			continue
 		}
 
+		// Every quad reads its constraints' counts, so large patterns
+		// can take a while to plan before the solver even starts
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		value := quad.String()
+		if j, has := quads[value]; has {
+			iter.duplicates[i] = j
+			continue
+		}
+		quads[value] = i
+
 		variables := [3]*variable{}
 		for p := 0; p < 3; p++ {
 			variables[p] = iter.parseNode(quad[p])
@@ -74,7 +141,12 @@ func newIterator(
 		for p := 0; p < 3; p++ {
 			if variables[p] == nil {
 				terms[p], err = dictionary.GetID(quad[p], rdf.Default)
-				if err != nil {
+				if err == ErrNotFound {
+					// A term that isn't in the database can't match anything,
+					// which is an empty result rather than an error.
+					iter.empty = true
+					return iter, nil
+				} else if err != nil {
 					return
 				}
 			} else {
@@ -83,6 +155,16 @@ func newIterator(
 		}
 
 		if degree == 0 {
+			// A quad without variables doesn't constrain anything,
+			// but the pattern has no solutions if it's not in the database.
+			_, err = txn.Get(assembleKey(prefixes.Ternary[SPO], false, terms[:]...))
+			if err == badger.ErrKeyNotFound {
+				iter.empty = true
+				return iter, nil
+			} else if err != nil {
+				return
+			}
+
 			iter.constants = append(iter.constants, &constraint{index: i, quad: quad})
 		} else if degree == 1 {
 			// Only one of the terms is a blank node, so this is a first-degree constraint.
@@ -154,16 +236,20 @@ func newIterator(
 				}
 			}
 		} else if degree == 3 {
-			return nil, fmt.Errorf("Cannot handle all-blank triple: %d", i)
-		}
-	}
+			// All three terms are distinct variables, so we insert
+			// three third-degree constraints that are each other's neighbors.
+			neighbors := make([]*constraint, 3)
+			for p := Permutation(0); p < 3; p++ {
+				neighbors[p] = &constraint{index: i, place: p, quad: quad, terms: terms, neighbors: neighbors, unbound: true}
+			}
 
-	// Make sure that every node in the domain
-	// actually occurs in the graph
-	for _, u := range iter.variables {
-		if len(u.cs) == 0 {
-			err = ErrInvalidDomain
-			return
+			for p := Permutation(0); p < 3; p++ {
+				q, r := (p+1)%3, (p+2)%3
+				err = iter.insertD3(variables[p], [2]*variable{variables[q], variables[r]}, neighbors[p], txn)
+				if err != nil {
+					return
+				}
+			}
 		}
 	}
 
@@ -171,11 +257,13 @@ func newIterator(
 	for _, u := range iter.variables {
 		u.norm = 0
 
-		for _, c := range u.cs {
+		counts := make([]uint32, len(u.cs))
+		for i, c := range u.cs {
 			u.norm += uint64(c.count) * uint64(c.count)
+			counts[i] = c.count
 		}
 
-		u.score = float64(u.norm) / float64(u.cs.Len())
+		u.score = score(counts)
 
 		u.Sort()
 
@@ -236,18 +324,21 @@ func newIterator(
 				// (which is just for outgoing connections)
 				cs.Close()
 				for _, c := range cs {
-					p := TernaryPrefixes[(c.place+1)%3]
-					c.iterator = txn.NewIterator(badger.IteratorOptions{
-						PrefetchValues: false,
-						Prefix:         []byte{p},
-					})
+					options := badger.IteratorOptions{PrefetchValues: false}
+					if !c.unbound {
+						options.Prefix = []byte{iter.prefixes.Ternary[(c.place+1)%3]}
+					}
+					c.iterator = txn.NewIterator(options)
 				}
 				delete(u.edges, j)
 			}
 		}
 	}
 
-	// Assemble the dependency maps
+	// Assemble the dependency maps. The edges that pointed backward were just deleted,
+	// so every dependency points from a variable to a later one: cycles in the pattern
+	// (like ?a :knows ?b . ?b :knows ?a) become a dependency of the later variable on
+	// both constraints, never a cycle in the dependency graph.
 	iter.in = make([][]int, len(iter.domain))
 	iter.out = make([][]int, len(iter.domain))
 
@@ -298,6 +389,15 @@ func newIterator(
 	return iter, iter.Seek(index)
 }
 
+// validLabel checks that a variable or blank node label can't be confused
+// with the rest of its id. Dictionaries join labels onto the id of their origin
+// with '#' (blank nodes, and so skolem IRIs) and '?' (variables), and the indices
+// separate ids with tabs, so a label containing any of these could resolve to a different
+// term than the one in the query - or to a stored skolem IRI.
+func validLabel(label string) bool {
+	return label != "" && !strings.ContainsAny(label, "#?\t\n ")
+}
+
 func (iter *Iterator) parseNode(node rdf.Term) *variable {
 	if node.TermType() != rdf.VariableType && node.TermType() != rdf.BlankNodeType {
 		return nil
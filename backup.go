@@ -0,0 +1,164 @@
+package styx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// Backup writes a full backup of the database (including the dictionary,
+// the datasets, and the application's own keys) in Badger's backup format
+func (s *Store) Backup(w io.Writer) error {
+	_, err := s.Badger.Backup(w, 0)
+	return err
+}
+
+// Restore loads a backup written by Backup into the database, which should be empty,
+// and then makes the indices consistent: the other two ternary permutations are
+// rewritten to match the subject-predicate-object keys (which are the only ones with
+// statements), and then every count is recomputed with Refresh. So a backup that
+// is missing count keys, or was taken from a store with drifted counts, restores
+// to a consistent store. The store must be opened with the same Config.Prefixes,
+// Config.OpaquePredicates, and kind of dictionary as the one that was backed up.
+// Badger doesn't load the values of large keys into in-memory databases,
+// so the database has to be on disk.
+func (s *Store) Restore(r io.Reader) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The IRI dictionary leases ids from a sequence that the backup overwrites,
+	// so it has to be released before loading and leased again from the restored value.
+	factory, is := s.Config.Dictionary.(*iriDictionaryFactory)
+	if is && factory.sequence != nil {
+		err := factory.sequence.Release()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.Badger.Load(r, 256)
+	if is && factory.sequence != nil {
+		if e := restoreSequence(s.Badger); err == nil {
+			err = e
+		}
+
+		var e error
+		factory.sequence, e = s.Badger.GetSequence(SequenceKey, SequenceBandwidth)
+		if err == nil {
+			err = e
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	err = s.repairTernary()
+	if err != nil {
+		return err
+	}
+
+	return s.refresh()
+}
+
+// restoreSequence sets the sequence key to the greatest of its versions.
+// Load keeps the versions of the keys in the backup, so the backup's sequence
+// key can be older than the one that the dictionary wrote before loading it.
+func restoreSequence(db *badger.DB) error {
+	var next uint64
+	err := db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{AllVersions: true, Prefix: SequenceKey})
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if string(item.Key()) != string(SequenceKey) || item.IsDeletedOrExpired() {
+				continue
+			}
+
+			err := item.Value(func(val []byte) error {
+				if len(val) == 8 && binary.BigEndian.Uint64(val) > next {
+					next = binary.BigEndian.Uint64(val)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, next)
+	return db.Update(func(txn *badger.Txn) error { return txn.Set(SequenceKey, val) })
+}
+
+// repairTernary writes the POS and OSP keys of every SPO key that's missing them,
+// and deletes the POS and OSP keys that don't have an SPO key
+func (s *Store) repairTernary() error {
+	prefixes := s.Config.Prefixes
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	opaque, err := s.opaqueIDs(dictionary)
+	if err != nil {
+		return err
+	}
+
+	txn := s.Badger.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	read := s.Badger.NewTransaction(false)
+	defer read.Discard()
+
+	for p := Permutation(0); p < 3; p++ {
+		iter := read.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{prefixes.Ternary[p]}})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().KeyCopy(nil)
+			ids := strings.Split(string(key[1:]), "\t")
+			if len(ids) != 3 {
+				iter.Close()
+				return fmt.Errorf("Unexpected ternary key: %v", key)
+			}
+
+			// Undo the permutation to get the subject, predicate, and object
+			var terms [3]ID
+			for j, i := range major[p] {
+				terms[i] = ID(ids[j])
+			}
+
+			if p == SPO {
+				for q := POS; q <= OSP && !opaque[terms[1]]; q++ {
+					a, b, c := major.permute(q, terms)
+					k := assembleKey(prefixes.Ternary[q], false, a, b, c)
+					if _, err = read.Get(k); err == badger.ErrKeyNotFound {
+						txn, err = setSafe(k, nil, txn, s.Badger)
+					}
+					if err != nil {
+						iter.Close()
+						return err
+					}
+				}
+			} else {
+				_, err = read.Get(assembleKey(prefixes.Ternary[SPO], false, terms[:]...))
+				if err == badger.ErrKeyNotFound || opaque[terms[1]] {
+					txn, err = deleteSafe(key, txn, s.Badger)
+				}
+				if err != nil {
+					iter.Close()
+					return err
+				}
+			}
+		}
+		iter.Close()
+	}
+
+	return txn.Commit()
+}
@@ -3,15 +3,183 @@ package styx
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
 
 	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
 )
 
-type unaryCache map[ID]*[6]uint32
+// CountKey returns the exact bytes of the count index key for the given terms,
+// so that external tools can precompute or verify the counts that the planner reads.
+// If b is nil, this is the unary key of a, whose value holds all six of a's counts.
+// Otherwise it is the binary key of a and b in the permutation p,
+// whose value is the number of distinct terms that complete the pair.
+func (s *Store) CountKey(p Permutation, a, b rdf.Term) ([]byte, error) {
+	if p > OPS {
+		return nil, ErrInvalidPermutation
+	}
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	x, err := dictionary.GetID(a, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	if b == nil {
+		return assembleKey(s.Config.Prefixes.Unary, false, x), nil
+	}
+
+	y, err := dictionary.GetID(b, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	return assembleKey(s.Config.Prefixes.Binary[p], false, x, y), nil
+}
+
+// Warm reads the given count keys (e.g. from CountKey) in a single transaction,
+// so that they're loaded into Badger's block cache before the first query needs them.
+// Iterators still keep their own caches, so this only saves the cold reads from disk.
+// Keys that don't exist are skipped.
+func (s *Store) Warm(keys [][]byte) error {
+	return s.Badger.View(func(txn *badger.Txn) error {
+		for _, key := range keys {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			err = item.Value(func(val []byte) error { return nil })
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Refresh recomputes every binary and unary count from the ternary index
+// and rewrites the count keys to match, deleting any that no longer count anything.
+// This repairs counts that have drifted (e.g. after an interrupted write)
+// without touching the ternary keys themselves. It also writes the range keys
+// of literal objects that don't have them yet, like the ones inserted before the
+// range index existed. All of the counts are held in memory.
+// Queries can run during a refresh and see the counts from before or after it,
+// and writes wait for it to finish.
+func (s *Store) Refresh() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.refresh()
+}
+
+func (s *Store) refresh() error {
+	prefixes := s.Config.Prefixes
+	uc := newUnaryCache(prefixes.Unary)
+	bc := newBinaryCache(prefixes.Binary)
+
+	count := func(p Permutation, a, b ID) {
+		key := string(assembleKey(prefixes.Binary[p], false, a, b))
+		if bc.counts[key] == 0 {
+			if _, has := uc.counts[a]; !has {
+				uc.counts[a] = &[6]uint32{}
+			}
+			uc.counts[a][p]++
+		}
+		bc.counts[key]++
+	}
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	opaque, err := s.opaqueIDs(dictionary)
+	if err != nil {
+		return err
+	}
+
+	txn := s.Badger.NewTransaction(true)
+	defer func() { txn.Discard() }()
+
+	objects := map[ID]bool{}
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{prefixes.Ternary[SPO]}})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := iter.Item().Key()
+		ids := strings.Split(string(key[1:]), "\t")
+		if len(ids) != 3 {
+			iter.Close()
+			return fmt.Errorf("Unexpected ternary key: %v", key)
+		}
+
+		terms := [3]ID{ID(ids[0]), ID(ids[1]), ID(ids[2])}
+		if !opaque[terms[1]] {
+			objects[terms[2]] = true
+		}
+
+		for p := Permutation(0); p < 3; p++ {
+			if p > 0 && opaque[terms[1]] {
+				break
+			}
+			a, b, _ := major.permute(p, terms)
+			count(p, a, b)
+			count(((p+1)%3)+3, b, a)
+		}
+	}
+	iter.Close()
+
+	// Zero out the count keys that don't count anything anymore so that Commit deletes them
+	for _, prefix := range append([]byte{prefixes.Unary}, prefixes.Binary[:]...) {
+		iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{prefix}})
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().KeyCopy(nil)
+			if prefix == prefixes.Unary {
+				if _, has := uc.counts[ID(key[1:])]; !has {
+					uc.counts[ID(key[1:])] = &[6]uint32{}
+				}
+			} else if _, has := bc.counts[string(key)]; !has {
+				bc.counts[string(key)] = 0
+			}
+		}
+		iter.Close()
+	}
+
+	txn, err = bc.Commit(s.Badger, txn)
+	if err != nil {
+		return err
+	}
+
+	txn, err = uc.Commit(s.Badger, txn)
+	if err != nil {
+		return err
+	}
+
+	for id := range objects {
+		object, err := dictionary.GetTerm(id, rdf.Default)
+		if err != nil {
+			return err
+		} else if object.TermType() != rdf.LiteralType {
+			continue
+		}
+
+		txn, err = s.indexValue(object, id, txn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit()
+}
+
+type unaryCache struct {
+	prefix byte
+	counts map[ID]*[6]uint32
+}
 
 // newUnaryCache creates a new IndexCache
-func newUnaryCache() unaryCache {
-	return unaryCache{}
+func newUnaryCache(prefix byte) unaryCache {
+	return unaryCache{prefix: prefix, counts: map[ID]*[6]uint32{}}
 }
 
 // getUnaryIndex returns the 6-tuple of counts from an item
@@ -29,31 +197,31 @@ func getUnaryIndex(item *badger.Item) (*[6]uint32, error) {
 }
 
 func (uc unaryCache) getIndex(a ID, txn *badger.Txn) (*[6]uint32, error) {
-	index, has := uc[a]
+	index, has := uc.counts[a]
 	if has {
 		return index, nil
 	}
 
-	key := assembleKey(UnaryPrefix, false, a)
+	key := assembleKey(uc.prefix, false, a)
 	item, err := txn.Get(key)
 	if err != nil {
 		return nil, err
 	}
 
-	uc[a] = &[6]uint32{}
+	uc.counts[a] = &[6]uint32{}
 	err = item.Value(func(val []byte) error {
 		if len(val) != 24 {
 			return fmt.Errorf("Unexpected index value: %v", val)
 		}
 		for i := 0; i < 6; i++ {
-			uc[a][i] = binary.BigEndian.Uint32(val[i*4 : (i+1)*4])
+			uc.counts[a][i] = binary.BigEndian.Uint32(val[i*4 : (i+1)*4])
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return uc[a], nil
+	return uc.counts[a], nil
 }
 
 func (uc unaryCache) Get(p Permutation, a ID, txn *badger.Txn) (uint32, error) {
@@ -70,11 +238,11 @@ func (uc unaryCache) Increment(p Permutation, a ID, txn *badger.Txn) error {
 	index, err := uc.getIndex(a, txn)
 	if err == badger.ErrKeyNotFound {
 		index = &[6]uint32{}
-		uc[a] = index
+		uc.counts[a] = index
 	} else if err != nil {
 		return err
 	}
-	uc[a][p]++
+	uc.counts[a][p]++
 	return nil
 }
 
@@ -82,12 +250,12 @@ func (uc unaryCache) Decrement(p Permutation, a ID, txn *badger.Txn) error {
 	index, err := uc.getIndex(a, txn)
 	if err == badger.ErrKeyNotFound {
 		index = &[6]uint32{}
-		uc[a] = index
+		uc.counts[a] = index
 	} else if err != nil {
 		return err
 	}
-	if uc[a][p] > 0 {
-		uc[a][p]--
+	if uc.counts[a][p] > 0 {
+		uc.counts[a][p]--
 	}
 	return nil
 }
@@ -95,8 +263,8 @@ func (uc unaryCache) Decrement(p Permutation, a ID, txn *badger.Txn) error {
 // Commit writes the contents of the index map to badger
 func (uc unaryCache) Commit(db *badger.DB, t *badger.Txn) (txn *badger.Txn, err error) {
 	txn = t
-	for term, index := range uc {
-		key := assembleKey(UnaryPrefix, false, term)
+	for term, index := range uc.counts {
+		key := assembleKey(uc.prefix, false, term)
 		zero := true
 		for _, c := range index {
 			if c > 0 {
@@ -123,17 +291,44 @@ func (uc unaryCache) Commit(db *badger.DB, t *badger.Txn) (txn *badger.Txn, err
 	return
 }
 
-type binaryCache map[string]uint32
+// Verify checks that the committed unary keys match the contents of the cache
+func (uc unaryCache) Verify(txn *badger.Txn) error {
+	for term, expected := range uc.counts {
+		key := assembleKey(uc.prefix, false, term)
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			if *expected != [6]uint32{} {
+				return ErrInconsistentCount
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		index, err := getUnaryIndex(item)
+		if err != nil {
+			return err
+		} else if *index != *expected {
+			return ErrInconsistentCount
+		}
+	}
+	return nil
+}
+
+type binaryCache struct {
+	prefixes [6]byte
+	counts   map[string]uint32
+}
 
 // newBinaryCache returns a new binary cache
-func newBinaryCache() binaryCache {
-	return binaryCache{}
+func newBinaryCache(prefixes [6]byte) binaryCache {
+	return binaryCache{prefixes: prefixes, counts: map[string]uint32{}}
 }
 
 func (bc binaryCache) Get(p Permutation, a, b ID, txn *badger.Txn) (uint32, error) {
-	key := assembleKey(BinaryPrefixes[p], false, a, b)
+	key := assembleKey(bc.prefixes[p], false, a, b)
 	s := string(key)
-	count, has := bc[s]
+	count, has := bc.counts[s]
 	if has {
 		return count, nil
 	}
@@ -146,28 +341,28 @@ func (bc binaryCache) Get(p Permutation, a, b ID, txn *badger.Txn) (uint32, erro
 	}
 
 	err = item.Value(func(val []byte) error {
-		bc[s] = binary.BigEndian.Uint32(val)
+		bc.counts[s] = binary.BigEndian.Uint32(val)
 		return nil
 	})
 	if err != nil {
 		return 0, err
 	}
-	return bc[s], nil
+	return bc.counts[s], nil
 }
 
 func (bc binaryCache) delta(p Permutation, a, b ID, increment bool, uc unaryCache, txn *badger.Txn) error {
-	key := assembleKey(BinaryPrefixes[p], false, a, b)
+	key := assembleKey(bc.prefixes[p], false, a, b)
 	s := string(key)
-	_, has := bc[s]
+	_, has := bc.counts[s]
 	if has {
 		if increment {
-			bc[s]++
-			if bc[s] == 1 {
+			bc.counts[s]++
+			if bc.counts[s] == 1 {
 				return uc.Increment(p, a, txn)
 			}
-		} else if bc[s] > 0 {
-			bc[s]--
-			if bc[s] == 0 {
+		} else if bc.counts[s] > 0 {
+			bc.counts[s]--
+			if bc.counts[s] == 0 {
 				return uc.Decrement(p, a, txn)
 			}
 		} else {
@@ -178,7 +373,7 @@ func (bc binaryCache) delta(p Permutation, a, b ID, increment bool, uc unaryCach
 
 	item, err := txn.Get(key)
 	if err == badger.ErrKeyNotFound && increment { // Hmm
-		bc[s] = 1
+		bc.counts[s] = 1
 		return uc.Increment(p, a, txn)
 	} else if err != nil {
 		return err
@@ -188,7 +383,7 @@ func (bc binaryCache) delta(p Permutation, a, b ID, increment bool, uc unaryCach
 		if len(val) != 4 {
 			return fmt.Errorf("Unexpected binary value: %v", val)
 		}
-		bc[s] = binary.BigEndian.Uint32(val)
+		bc.counts[s] = binary.BigEndian.Uint32(val)
 		return nil
 	})
 	if err != nil {
@@ -196,12 +391,12 @@ func (bc binaryCache) delta(p Permutation, a, b ID, increment bool, uc unaryCach
 	}
 
 	if increment {
-		bc[s]++
-	} else if bc[s] == 1 {
-		bc[s] = 0
+		bc.counts[s]++
+	} else if bc.counts[s] == 1 {
+		bc.counts[s] = 0
 		return uc.Decrement(p, a, txn)
-	} else if bc[s] > 0 {
-		bc[s]--
+	} else if bc.counts[s] > 0 {
+		bc.counts[s]--
 	} else {
 		// ???
 	}
@@ -219,7 +414,7 @@ func (bc binaryCache) Decrement(p Permutation, a, b ID, uc unaryCache, txn *badg
 // Commit writes the contents of the index map to badger
 func (bc binaryCache) Commit(db *badger.DB, t *badger.Txn) (txn *badger.Txn, err error) {
 	txn = t
-	for key, count := range bc {
+	for key, count := range bc.counts {
 		if count == 0 {
 			txn, err = deleteSafe([]byte(key), txn, db)
 			if err == badger.ErrKeyNotFound {
@@ -237,3 +432,29 @@ func (bc binaryCache) Commit(db *badger.DB, t *badger.Txn) (txn *badger.Txn, err
 	}
 	return
 }
+
+// Verify checks that the committed binary keys match the contents of the cache
+func (bc binaryCache) Verify(txn *badger.Txn) error {
+	for key, expected := range bc.counts {
+		item, err := txn.Get([]byte(key))
+		if err == badger.ErrKeyNotFound {
+			if expected != 0 {
+				return ErrInconsistentCount
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		err = item.Value(func(val []byte) error {
+			if len(val) != 4 || binary.BigEndian.Uint32(val) != expected {
+				return ErrInconsistentCount
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -62,6 +62,58 @@ var ErrInvalidDomain = errors.New("Invalid domain")
 // ErrInvalidIndex means that provided index included blank nodes or that it was too long
 var ErrInvalidIndex = errors.New("Invalid index")
 
+// ErrInvalidLabel means that a query used a variable or blank node label that collides with the id scheme
+var ErrInvalidLabel = errors.New("Invalid variable label")
+
+// ErrUnboundTriple means that a query had a triple without any constant terms
+// that repeats a variable (e.g. ?s ?p ?s). Triples of three distinct variables
+// scan every term instead, but a repeated one would also have to be checked
+// against the major index for each candidate value.
+var ErrUnboundTriple = errors.New("Cannot query a triple without constant terms")
+
+// ErrInvalidList means that an rdf:first / rdf:rest chain was malformed or cyclic
+var ErrInvalidList = errors.New("Invalid list")
+
+// ErrPrefixCollision means that two key families, or a key family and a reserved byte, share a prefix
+var ErrPrefixCollision = errors.New("Prefix collision")
+
+// ErrPrefixMismatch means that the database was written with different prefixes than the store's
+var ErrPrefixMismatch = errors.New("Prefix mismatch")
+
+// ErrHashMismatch means that a dictionary shared with another store was given a different hash function
+var ErrHashMismatch = errors.New("Hash function mismatch")
+
+// ErrInvalidInterval means that a Verifier was started with an interval that isn't positive
+var ErrInvalidInterval = errors.New("Invalid interval")
+
+// ErrQueueFull means that an Executor had too many queries waiting to accept another one
+var ErrQueueFull = errors.New("Query queue full")
+
+// ErrInvalidPermutation means that a given permutation was out of range
+var ErrInvalidPermutation = errors.New("Invalid permutation")
+
+// ErrInconsistentCount means that a count key didn't hold the value that was written to it
+var ErrInconsistentCount = errors.New("Inconsistent count")
+
+// ErrOpaquePredicate means that a pattern needs the object index of an opaque predicate
+var ErrOpaquePredicate = errors.New("Cannot query the objects of an opaque predicate without a subject")
+
+// ErrInvalidRange means that the bounds of a range weren't comparable literals
+var ErrInvalidRange = errors.New("Invalid range")
+
+// ErrUnexpectedDataset means that a normalized document didn't match its expected serialization
+var ErrUnexpectedDataset = errors.New("Unexpected dataset")
+
+// ErrTimeout means that the iterator's timeout elapsed before it found another solution
+var ErrTimeout = errors.New("Query timed out")
+
+// ErrInvalidFilter means that a filter's operator isn't one of =, !=, <, <=, >, and >=,
+// or that its value is a malformed date
+var ErrInvalidFilter = errors.New("Invalid filter")
+
+// ErrStaleCursor means that a cursor no longer matches its query or the database
+var ErrStaleCursor = errors.New("Stale cursor")
+
 // Algorithm has to be URDNA2015
 const Algorithm = "URDNA2015"
 
@@ -80,6 +132,19 @@ const ValueToIDPrefix = byte('>')
 // IDToValuePrefix keys translate uint64 ids to string IRIs
 const IDToValuePrefix = byte('<')
 
+// MetadataPrefix keys store the application metadata attached to datasets
+const MetadataPrefix = byte('@')
+
+// SearchPrefix keys map the words of literals to their ids
+const SearchPrefix = byte('~')
+
+// RangePrefix keys map the ids of numeric and date literals to
+// the encodings of their values, which Range compares to its bounds
+const RangePrefix = byte('^')
+
+// HashPrefix starts the ids of literals stored under the hash of their value
+const HashPrefix = byte('&')
+
 // UnaryPrefix keys translate ld.Node values to uint64 ids
 const UnaryPrefix = byte('u')
 
@@ -88,3 +153,48 @@ var TernaryPrefixes = [3]byte{'a', 'b', 'c'}
 
 // BinaryPrefixes address the binary indices
 var BinaryPrefixes = [6]byte{'i', 'j', 'k', 'l', 'm', 'n'}
+
+// Prefixes are the first bytes of a store's index, dataset, metadata, search,
+// and range keys. Applications that keep their own keys in the same Badger database
+// can move them out of their way with Config.Prefixes, and several stores
+// can share one database as separate namespaces by giving each of them
+// its own prefixes. The dictionary and schema keys (SequenceKey,
+// ValueToIDPrefix, IDToValuePrefix, and SchemaKey) are shared
+// by every namespace. See prefixes.go for the whole allocation.
+type Prefixes struct {
+	Ternary  [3]byte
+	Binary   [6]byte
+	Unary    byte
+	Dataset  byte // Zero means DatasetPrefix
+	Metadata byte // Zero means MetadataPrefix
+	Search   byte // Zero means SearchPrefix
+	Range    byte // Zero means RangePrefix
+}
+
+// DefaultPrefixes are the prefixes that stores use unless configured otherwise
+var DefaultPrefixes = Prefixes{
+	Ternary:  TernaryPrefixes,
+	Binary:   BinaryPrefixes,
+	Unary:    UnaryPrefix,
+	Dataset:  DatasetPrefix,
+	Metadata: MetadataPrefix,
+	Search:   SearchPrefix,
+	Range:    RangePrefix,
+}
+
+// validate checks that all of the store's key families
+// have distinct prefixes and that none of them are reserved
+func (p *Prefixes) validate(reserved []byte) error {
+	used := make(map[byte]bool, len(reserved))
+	for _, b := range reserved {
+		used[b] = true
+	}
+
+	for _, b := range p.families() {
+		if used[b] {
+			return ErrPrefixCollision
+		}
+		used[b] = true
+	}
+	return nil
+}
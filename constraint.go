@@ -2,8 +2,9 @@ package styx
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
+	"sort"
+	"strings"
 
 	badger "github.com/dgraph-io/badger/v2"
 	rdf "github.com/underlay/go-rdfjs"
@@ -19,6 +20,20 @@ type constraint struct {
 	quad      *rdf.Quad
 	terms     [3]ID
 	neighbors []*constraint
+	counter   byte // The prefix of the count key that count was read from
+	reads     int  // The number of cursor reads the constraint has made
+	// If the variable occurs twice in the triple (e.g. ?a :knows ?a), the prefix
+	// only fixes the constant term, so every candidate value also has to be checked
+	// against the major ternary index for the triple that repeats it.
+	txn   *badger.Txn
+	major byte
+	// If the triple has no constant terms (e.g. ?s ?p ?o), its constraints
+	// switch between the unary, binary, and ternary indices as values are pushed.
+	unbound bool
+	// A constraint from Iterator.Range scans the range index, and skips the literals
+	// whose values (see orderedKey) aren't of its kind or between its bounds.
+	kind     byte
+	min, max []byte
 }
 
 // cache is a struct for holding cached value states
@@ -40,14 +55,14 @@ func (c *constraint) print(p Permutation) string {
 	return c.quad[p].String()
 }
 
-func (c *constraint) Sources(value ID, txn *badger.Txn) (statements []*Statement, err error) {
+func (c *constraint) Sources(value ID, prefix byte, txn *badger.Txn) (statements []*Statement, err error) {
 	var item *badger.Item
 	if c.place == 0 {
 		item = c.iterator.Item()
 	} else {
 		c.terms[c.place] = value
 		s, p, o := c.terms[0], c.terms[1], c.terms[2]
-		key := assembleKey(TernaryPrefixes[0], false, s, p, o)
+		key := assembleKey(prefix, false, s, p, o)
 		item, err = txn.Get(key)
 		if err != nil {
 			return
@@ -63,28 +78,28 @@ func (c *constraint) Sources(value ID, txn *badger.Txn) (statements []*Statement
 }
 
 func (c *constraint) String() string {
-	if len(c.prefix) == 9 {
-		return fmt.Sprintf(
-			"(p%d {%s | %s} %s:%02d#%d)",
-			c.place,
-			c.print((c.place+1)%3), c.print((c.place+2)%3),
-			string(c.prefix[0]),
-			binary.BigEndian.Uint64(c.prefix[1:]),
-			c.count,
-		)
-	} else if len(c.prefix) == 17 {
-		return fmt.Sprintf(
-			"(p%d {%s | %s} %s:%02d:%02d#%d)",
-			c.place,
-			c.print((c.place+1)%3), c.print((c.place+2)%3),
-			string(c.prefix[0]),
-			binary.BigEndian.Uint64(c.prefix[1:9]),
-			binary.BigEndian.Uint64(c.prefix[9:]),
-			c.count,
-		)
-	} else {
+	if len(c.prefix) == 0 {
 		return "<<<invalid constraint>>>"
+	} else if c.kind != 0 {
+		return fmt.Sprintf("(range %c #%d)", c.kind, c.count)
+	}
+
+	// The cursor's position is the value it's currently on, if it has one
+	var position string
+	if c.iterator != nil && c.iterator.ValidForPrefix(c.prefix) {
+		position = fmt.Sprintf(" @%s", c.iterator.Item().Key()[len(c.prefix):])
 	}
+
+	terms := strings.Split(strings.TrimSuffix(string(c.prefix[1:]), "\t"), "\t")
+	return fmt.Sprintf(
+		"(p%d {%s | %s} %s:%s#%d%s)",
+		c.place,
+		c.print((c.place+1)%3), c.print((c.place+2)%3),
+		string(c.prefix[0]),
+		strings.Join(terms, ":"),
+		c.count,
+		position,
+	)
 }
 
 // Close the constraint's iterator, if it exists
@@ -95,22 +110,57 @@ func (c *constraint) Close() {
 	}
 }
 
-func (c *constraint) value() (v ID) {
-	if c.iterator.ValidForPrefix(c.prefix) {
+func (c *constraint) value() ID {
+	for c.iterator.ValidForPrefix(c.prefix) {
 		item := c.iterator.Item()
 		key := item.KeyCopy(nil)
+		if c.kind != 0 {
+			if c.contains(item) {
+				return ID(key[len(c.prefix):])
+			}
+			c.reads++
+			c.iterator.Next()
+			continue
+		}
+
 		i := bytes.LastIndexByte(key, '\t')
 		if i == -1 {
 			i = 0
 		}
-		v = ID(key[i+1:])
+
+		v := ID(key[i+1:])
+		if c.txn == nil {
+			return v
+		}
+
+		terms := c.terms
+		terms[c.place], terms[(c.place+1)%3] = v, v
+		_, err := c.txn.Get(assembleKey(c.major, false, terms[:]...))
+		if err == nil {
+			return v
+		}
+
+		c.reads++
+		c.iterator.Next()
 	}
 
-	return
+	return NIL
+}
+
+// contains checks whether the value of a range key is in the constraint's range
+func (c *constraint) contains(item *badger.Item) (in bool) {
+	err := item.Value(func(val []byte) error {
+		in = len(val) > 0 && val[0] == c.kind &&
+			(c.min == nil || bytes.Compare(val, c.min) >= 0) &&
+			(c.max == nil || bytes.Compare(val, c.max) <= 0)
+		return nil
+	})
+	return err == nil && in
 }
 
 // Next advances the iterator and returns the next value
 func (c *constraint) Next() ID {
+	c.reads++
 	c.iterator.Next()
 	return c.value()
 }
@@ -123,21 +173,28 @@ func (c *constraint) Seek(v ID) ID {
 	if v != NIL {
 		copy(key[len(c.prefix):], v)
 	}
+	c.reads++
 	c.iterator.Seek(key)
 	return c.value()
 }
 
+// getCount returns the number of values that satisfy the constraint on its own.
+// The two binary keys of a pair always count the same triples, so it reads just one.
 func (c *constraint) getCount(uc unaryCache, bc binaryCache, txn *badger.Txn) (uint32, error) {
 	j, k := (c.place+1)%3, (c.place+2)%3
 	v, w := c.terms[j], c.terms[k]
 	if v == NIL && w == NIL {
-		// AAAA return the total number of variables??
+		// A constraint of a triple without constant terms scans every term,
+		// and there's no count of those, so this just sorts it after the others
 		return 48329, nil
 	} else if v == NIL {
+		c.counter = uc.prefix
 		return uc.Get(k, w, txn)
 	} else if w == NIL {
+		c.counter = uc.prefix
 		return uc.Get(j+3, v, txn)
 	} else {
+		c.counter = bc.prefixes[j]
 		return bc.Get(j, v, w, txn)
 	}
 }
@@ -191,9 +248,7 @@ func (cs constraintSet) Seek(v ID) ID {
 
 // Next value (could be improved to not double-check the first constraint)
 func (cs constraintSet) Next() (next ID) {
-	c := cs[0]
-	c.iterator.Next()
-	next = c.value()
+	next = cs[0].Next()
 	if next != NIL && len(cs) > 1 {
 		next = cs.Seek(next)
 	}
@@ -210,3 +265,17 @@ func (cm constraintMap) Len() (l int) {
 	}
 	return
 }
+
+// String prints the constraint sets in increasing order of their variable index,
+// so that it's stable across runs
+func (cm constraintMap) String() (s string) {
+	keys := make([]int, 0, len(cm))
+	for id := range cm {
+		keys = append(keys, id)
+	}
+	sort.Ints(keys)
+	for _, id := range keys {
+		s += fmt.Sprintf("  %d: %s\n", id, cm[id].String())
+	}
+	return
+}
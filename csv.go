@@ -0,0 +1,82 @@
+package styx
+
+import (
+	"encoding/csv"
+	"io"
+	"strings"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// WriteCSV writes the given solutions to w in the SPARQL 1.1 CSV results format,
+// with one column per node in the domain. IRIs are written bare, blank nodes as _:label,
+// and literals as their lexical form, so datatypes and language tags are lost.
+// Unbound values are written as empty cells.
+func WriteCSV(w io.Writer, domain []rdf.Term, solutions [][]rdf.Term) error {
+	writer := csv.NewWriter(w)
+	writer.UseCRLF = true
+
+	record := make([]string, len(domain))
+	for i, node := range domain {
+		record[i] = node.Value()
+	}
+
+	err := writer.Write(record)
+	if err != nil {
+		return err
+	}
+
+	for _, solution := range solutions {
+		for i := range record {
+			record[i] = ""
+			if i < len(solution) && solution[i] != nil {
+				switch term := solution[i].(type) {
+				case *rdf.BlankNode:
+					record[i] = term.String()
+				default:
+					record[i] = term.Value()
+				}
+			}
+		}
+
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteTSV writes the given solutions to w in the SPARQL 1.1 TSV results format,
+// with one column per node in the domain. Every value is written in its
+// N-Triples form, so unlike CSV the results can be parsed back into terms.
+// Unbound values are written as empty cells.
+func WriteTSV(w io.Writer, domain []rdf.Term, solutions [][]rdf.Term) error {
+	record := make([]string, len(domain))
+	for i, node := range domain {
+		record[i] = "?" + node.Value()
+	}
+
+	_, err := io.WriteString(w, strings.Join(record, "\t")+"\n")
+	if err != nil {
+		return err
+	}
+
+	for _, solution := range solutions {
+		for i := range record {
+			record[i] = ""
+			if i < len(solution) && solution[i] != nil {
+				record[i] = solution[i].String()
+			}
+		}
+
+		_, err = io.WriteString(w, strings.Join(record, "\t")+"\n")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
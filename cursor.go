@@ -0,0 +1,92 @@
+package styx
+
+import (
+	"bytes"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// Cursor returns an opaque token for the iterator's current solution,
+// which Resume uses to continue the same query after it in a new transaction.
+// The token is the iterator's domain and index, one N-Quads term pair per line,
+// so it doesn't depend on the state of the iterator's constraint cursors.
+// Cursor returns ErrEndOfSolutions if the iterator doesn't have a current solution.
+func (iter *Iterator) Cursor() ([]byte, error) {
+	if iter.empty || iter.top || iter.bot {
+		return nil, ErrEndOfSolutions
+	}
+
+	var token bytes.Buffer
+	for i, term := range iter.Index() {
+		if term == nil {
+			return nil, ErrEndOfSolutions
+		}
+		token.WriteString(iter.domain[i].String())
+		token.WriteByte('\t')
+		token.WriteString(term.String())
+		token.WriteByte('\n')
+	}
+
+	return token.Bytes(), nil
+}
+
+// Resume opens a query for the pattern that continues after the solution
+// of the given cursor token: the first call to Next returns the next solution.
+// If the solution has since been deleted, Next returns the first solution
+// that would have come after it. Resume returns ErrStaleCursor if the token
+// doesn't match the pattern's variables or uses a term that the dictionary
+// can't find (literals have content-addressed ids in the IRI dictionary,
+// so they can always be found).
+func (s *Store) Resume(pattern []*rdf.Quad, token []byte) (*Iterator, error) {
+	lines := bytes.Split(bytes.TrimSuffix(token, []byte{'\n'}), []byte{'\n'})
+	domain, index := make([]rdf.Term, len(lines)), make([]rdf.Term, len(lines))
+	for i, line := range lines {
+		terms := bytes.Split(line, []byte{'\t'})
+		if len(terms) != 2 {
+			return nil, ErrInvalidIndex
+		}
+
+		var err error
+		if domain[i], err = rdf.ParseTerm(string(terms[0])); err != nil {
+			return nil, ErrInvalidIndex
+		} else if index[i], err = rdf.ParseTerm(string(terms[1])); err != nil {
+			return nil, ErrInvalidIndex
+		}
+	}
+
+	iter, err := s.Query(pattern, domain, nil)
+	if err == ErrInvalidDomain {
+		return nil, ErrStaleCursor
+	} else if err != nil {
+		return nil, err
+	} else if iter.empty || iter.top {
+		return iter, nil
+	}
+
+	if iter.Len() != len(domain) {
+		iter.Close()
+		return nil, ErrStaleCursor
+	}
+
+	err = iter.Seek(index)
+	if err == ErrNotFound {
+		iter.Close()
+		return nil, ErrStaleCursor
+	} else if err != nil {
+		iter.Close()
+		return nil, err
+	} else if iter.top {
+		return iter, nil
+	}
+
+	// Skip the token's own solution if it's still there
+	current := iter.Index()
+	for i, term := range current {
+		if term == nil || !term.Equal(index[i]) {
+			return iter, nil
+		}
+	}
+
+	iter.bot = false
+	return iter, nil
+}
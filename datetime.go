@@ -0,0 +1,43 @@
+package styx
+
+import (
+	"strings"
+	"time"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+const xsdDateTime = "http://www.w3.org/2001/XMLSchema#dateTime"
+
+// normalizeDateTime rewrites an xsd:dateTime literal with a timezone
+// into the equivalent instant in UTC, so that literals that denote the same
+// instant have the same lexical form. Everything else (including dateTimes
+// without a timezone, which don't denote a single instant) is returned unchanged.
+func normalizeDateTime(term rdf.Term) rdf.Term {
+	literal, is := term.(*rdf.Literal)
+	if !is || literal.Datatype().Value() != xsdDateTime {
+		return term
+	}
+
+	value, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(literal.Value()))
+	if err != nil {
+		return term
+	}
+
+	datatype := rdf.NewNamedNode(xsdDateTime)
+	return rdf.NewLiteral(value.UTC().Format(time.RFC3339Nano), "", datatype)
+}
+
+// normalizeDateTimes applies normalizeDateTime to every term of the quads
+func normalizeDateTimes(quads []*rdf.Quad) []*rdf.Quad {
+	result := make([]*rdf.Quad, len(quads))
+	for i, quad := range quads {
+		result[i] = rdf.NewQuad(
+			normalizeDateTime(quad[0]),
+			normalizeDateTime(quad[1]),
+			normalizeDateTime(quad[2]),
+			quad[3],
+		)
+	}
+	return result
+}
@@ -1,12 +1,22 @@
 package styx
 
 import (
+	"bytes"
+	"sort"
+
 	badger "github.com/dgraph-io/badger/v2"
 	rdf "github.com/underlay/go-rdfjs"
 )
 
 // Delete a dataset from the database
-func (s *Store) Delete(node rdf.Term) (err error) {
+func (s *Store) Delete(node rdf.Term) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.deleteDataset(node)
+}
+
+// deleteDataset is Delete for callers that already hold s.lock
+func (s *Store) deleteDataset(node rdf.Term) (err error) {
 	dictionary := s.Config.Dictionary.Open(false)
 	txn := s.Badger.NewTransaction(true)
 	defer func() { txn.Discard(); dictionary.Commit() }()
@@ -21,7 +31,17 @@ func (s *Store) Delete(node rdf.Term) (err error) {
 		return
 	}
 
-	txn, err = deleteQuads(origin, quads, dictionary, txn, s.Badger)
+	opaque, err := s.opaqueIDs(dictionary)
+	if err != nil {
+		return
+	}
+
+	txn, err = deleteQuads(origin, quads, nil, s.Config.Prefixes, opaque, dictionary, txn, s.Badger)
+	if err != nil {
+		return
+	}
+
+	txn, err = deleteSafe(assembleKey(s.Config.Prefixes.Metadata, false, origin), txn, s.Badger)
 	if err != nil {
 		return
 	}
@@ -34,17 +54,187 @@ func (s *Store) Delete(node rdf.Term) (err error) {
 	return s.Config.QuadStore.Delete(origin)
 }
 
-// Delete removes a dataset from the database
-func deleteQuads(origin ID, quads [][4]ID, dictionary Dictionary, t *badger.Txn, db *badger.DB) (txn *badger.Txn, err error) {
+// Retract removes the given quads from a dataset, leaving the rest of it in place.
+// Quads that other datasets also assert keep their index keys, and counts that
+// reach zero are deleted, just like with Delete. Retracting every quad deletes the dataset.
+// Quads that aren't in the dataset are ignored. With Config.NormalizeDateTimes,
+// the quads are normalized first, so they match the normalized quads that Set stored.
+// The dataset is read and rewritten while holding the store's write lock,
+// so concurrent writes to it can't be lost in between.
+func (s *Store) Retract(node rdf.Term, quads []*rdf.Quad) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dataset, err := s.Get(node)
+	if err != nil {
+		return err
+	}
+
+	if s.Config.NormalizeDateTimes {
+		quads = normalizeDateTimes(quads)
+	}
+
+	retracted := make(map[string]bool, len(quads))
+	for _, quad := range quads {
+		retracted[quad.String()] = true
+	}
+
+	remaining := make([]*rdf.Quad, 0, len(dataset))
+	for _, quad := range dataset {
+		if !retracted[quad.String()] {
+			remaining = append(remaining, quad)
+		}
+	}
+
+	if len(remaining) == len(dataset) {
+		return nil
+	} else if len(remaining) == 0 {
+		return s.deleteDataset(node)
+	}
+
+	return s.setMany([]rdf.Term{node}, [][]*rdf.Quad{remaining})
+}
+
+// RetractJSONLD normalizes a JSON-LD document the same way SetJSONLD does
+// and retracts its quads from the dataset with the given URI.
+func (s *Store) RetractJSONLD(uri string, input interface{}, canonize bool) error {
+	node, quads, err := normalizeJSONLD(uri, input, canonize)
+	if err != nil {
+		return err
+	}
+	return s.Retract(node, fromLdQuads(quads))
+}
+
+// A DeletePlan describes what Delete would remove for a dataset
+type DeletePlan struct {
+	// Statements are the URIs of the dataset's statements
+	Statements []string
+	// Quads are the triples that no other dataset asserts,
+	// which are removed from the indices entirely
+	Quads []*rdf.Quad
+	// Keys are the count keys (see CountKey) that would reach zero and be deleted
+	Keys [][]byte
+}
+
+// DeletePreview returns the plan that Delete would carry out for the dataset,
+// computed with the same count bookkeeping as Delete in a read-only transaction.
+func (s *Store) DeletePreview(node rdf.Term) (*DeletePlan, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	txn := s.Badger.NewTransaction(false)
+	defer func() { txn.Discard(); dictionary.Commit() }()
+
+	origin, err := dictionary.GetID(node, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	quads, err := s.Config.QuadStore.Get(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	opaque, err := s.opaqueIDs(dictionary)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &DeletePlan{Statements: []string{}, Quads: []*rdf.Quad{}, Keys: [][]byte{}}
+	bc := newBinaryCache(s.Config.Prefixes.Binary)
+	uc := newUnaryCache(s.Config.Prefixes.Unary)
+	visited := map[string]bool{}
+	for _, quad := range quads {
+		key := assembleKey(s.Config.Prefixes.Ternary[0], false, quad[:3]...)
+		if visited[string(key)] {
+			continue
+		}
+		visited[string(key)] = true
+
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var statements []*Statement
+		err = item.Value(func(val []byte) (err error) {
+			statements, err = getStatements(val)
+			return
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		retained := false
+		for _, statement := range statements {
+			if ID(statement.base) == origin {
+				plan.Statements = append(plan.Statements, statement.URI(dictionary))
+			} else {
+				retained = true
+			}
+		}
+
+		if retained {
+			continue
+		}
+
+		terms := [3]rdf.Term{}
+		for i, id := range quad[:3] {
+			terms[i], err = dictionary.GetTerm(id, rdf.Default)
+			if err != nil {
+				return nil, err
+			}
+		}
+		plan.Quads = append(plan.Quads, rdf.NewQuad(terms[0], terms[1], terms[2], rdf.Default))
+
+		for p := Permutation(0); p < 3; p++ {
+			if !opaque[quad[1]] || p == SPO {
+				err = bc.Decrement(p, quad[p], quad[(p+1)%3], uc, txn)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if !opaque[quad[1]] || p+3 == PSO {
+				err = bc.Decrement(p+3, quad[p], quad[(p+2)%3], uc, txn)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for key, count := range bc.counts {
+		if count == 0 {
+			plan.Keys = append(plan.Keys, []byte(key))
+		}
+	}
+
+	for term, index := range uc.counts {
+		if *index == [6]uint32{} {
+			plan.Keys = append(plan.Keys, assembleKey(uc.prefix, false, term))
+		}
+	}
+
+	sort.Slice(plan.Keys, func(i, j int) bool { return bytes.Compare(plan.Keys[i], plan.Keys[j]) < 0 })
+	return plan, nil
+}
+
+// deleteQuads removes a dataset's statements from the database.
+// Triples whose ternary keys are in retain are about to be re-inserted,
+// so when they lose their last statement we leave their index and count keys in place.
+// Literals that are no longer the object of any triple lose their search and range keys.
+func deleteQuads(origin ID, quads [][4]ID, retain map[string]bool, prefixes *Prefixes, opaque map[ID]bool, dictionary Dictionary, t *badger.Txn, db *badger.DB) (txn *badger.Txn, err error) {
 	txn = t
 
-	bc := newBinaryCache()
-	uc := newUnaryCache()
+	bc := newBinaryCache(prefixes.Binary)
+	uc := newUnaryCache(prefixes.Unary)
 
+	objects := map[ID]bool{}
 	for _, quad := range quads {
 		terms := [3]ID{quad[0], quad[1], quad[2]}
 		var item *badger.Item
-		p := TernaryPrefixes[0]
+		p := prefixes.Ternary[0]
 		key := assembleKey(p, false, quad[:3]...)
 		item, err = txn.Get(key)
 		if err == badger.ErrKeyNotFound {
@@ -69,12 +259,28 @@ func deleteQuads(origin ID, quads [][4]ID, dictionary Dictionary, t *badger.Txn,
 				val = append(val, x.String()...)
 			}
 		}
-		if len(val) > 0 {
+		if len(val) > 0 || retain[string(key)] {
 			txn, err = setSafe(key, val, txn, db)
 			if err != nil {
 				return
 			}
+		} else if opaque[terms[1]] {
+			err = bc.Decrement(SPO, terms[0], terms[1], uc, txn)
+			if err != nil {
+				return
+			}
+
+			err = bc.Decrement(PSO, terms[1], terms[0], uc, txn)
+			if err != nil {
+				return
+			}
+
+			txn, err = deleteSafe(key, txn, db)
+			if err != nil {
+				return
+			}
 		} else {
+			objects[terms[2]] = true
 			err = bc.Decrement(0, terms[0], terms[1], uc, txn)
 			if err != nil {
 				return
@@ -102,7 +308,7 @@ func deleteQuads(origin ID, quads [][4]ID, dictionary Dictionary, t *badger.Txn,
 					return
 				}
 
-				key := assembleKey(TernaryPrefixes[p], false, a, b, c)
+				key := assembleKey(prefixes.Ternary[p], false, a, b, c)
 				txn, err = deleteSafe(key, txn, db)
 				if err == badger.ErrKeyNotFound {
 					// ???
@@ -114,6 +320,30 @@ func deleteQuads(origin ID, quads [][4]ID, dictionary Dictionary, t *badger.Txn,
 		}
 	}
 
+	for object := range objects {
+		if index, has := uc.counts[object]; !has || index[OSP] > 0 {
+			continue
+		}
+
+		var term rdf.Term
+		term, err = dictionary.GetTerm(object, rdf.Default)
+		if err != nil {
+			return
+		} else if term.TermType() != rdf.LiteralType {
+			continue
+		}
+
+		txn, err = deleteTokens(term, object, prefixes, txn, db)
+		if err != nil {
+			return
+		}
+
+		txn, err = deleteValue(object, prefixes, txn, db)
+		if err != nil {
+			return
+		}
+	}
+
 	txn, err = bc.Commit(db, txn)
 	if err != nil {
 		return
@@ -1,6 +1,8 @@
 package styx
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"regexp"
@@ -86,9 +88,11 @@ func (s stringDictionary) GetTerm(id ID, origin rdf.Term) (rdf.Term, error) {
 const SequenceBandwidth = 512
 
 type iriDictionaryFactory struct {
-	tags     TagScheme
-	db       *badger.DB
-	sequence *badger.Sequence
+	tags      TagScheme
+	db        *badger.DB
+	sequence  *badger.Sequence
+	threshold int
+	hash      HashFunction
 }
 
 type iriDictionary struct {
@@ -99,9 +103,10 @@ type iriDictionary struct {
 	ids     map[string]iri
 }
 
-// MakeIriDictionary returns a new dictionary factory that compacts IRIs with base64 IDs
+// MakeIriDictionary returns a new dictionary factory that compacts IRIs with base64 IDs.
+// If the database was opened read-only, the dictionary can only read existing ids.
 func MakeIriDictionary(tags TagScheme, db *badger.DB) (DictionaryFactory, error) {
-	factory := &iriDictionaryFactory{tags: tags, db: db}
+	factory := &iriDictionaryFactory{tags: tags, db: db, hash: SHA256}
 
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
@@ -124,13 +129,45 @@ func MakeIriDictionary(tags TagScheme, db *badger.DB) (DictionaryFactory, error)
 	}
 
 	factory.sequence, err = db.GetSequence(SequenceKey, SequenceBandwidth)
-	if err != nil {
+	if err == badger.ErrReadOnlyTxn {
+		// A read-only database can't lease ids, so its dictionary only looks them up
+		return factory, nil
+	} else if err != nil {
 		return nil, err
 	}
 
 	return factory, nil
 }
 
+// MakeHashDictionary returns an IRI dictionary that also stores literals longer than
+// threshold bytes once, under the hash of their value, so that the index keys
+// (and the equality joins on them) only ever contain fixed-size ids for large literals.
+// Since the ids are content-addressed, identical large values are deduplicated
+// automatically and queries can compute them without reading the database.
+func MakeHashDictionary(tags TagScheme, db *badger.DB, threshold int) (DictionaryFactory, error) {
+	factory, err := MakeIriDictionary(tags, db)
+	if err != nil {
+		return nil, err
+	}
+	factory.(*iriDictionaryFactory).threshold = threshold
+	return factory, nil
+}
+
+// A HashFunction digests values into content-addressed ids
+type HashFunction func(data []byte) []byte
+
+// SHA256 is the default HashFunction
+func SHA256(data []byte) []byte {
+	hash := sha256.Sum256(data)
+	return hash[:]
+}
+
+// hashLiteral returns the content-addressed id of a serialized literal
+func (factory *iriDictionaryFactory) hashLiteral(value string) iri {
+	hash := factory.hash([]byte(value))
+	return iri(string(HashPrefix) + base64.RawStdEncoding.EncodeToString(hash))
+}
+
 func (factory *iriDictionaryFactory) Close() (err error) {
 	if factory.sequence != nil {
 		err = factory.sequence.Release()
@@ -234,14 +271,33 @@ func (d *iriDictionary) GetID(term rdf.Term, origin rdf.Term) (ID, error) {
 	case *rdf.Literal:
 		escaped := "\"" + escape(value) + "\""
 		datatype, language := term.Datatype(), term.Language()
-		if datatype == nil || datatype.Equal(rdf.XSDString) {
-			return ID(escaped), nil
-		} else if datatype.Equal(rdf.RDFLangString) {
-			return ID(escaped + "@" + language), nil
-		} else {
+		if datatype != nil && datatype.Equal(rdf.RDFLangString) {
+			escaped += "@" + language
+		} else if datatype != nil && !datatype.Equal(rdf.XSDString) {
 			id, err := d.getIRI(datatype.Value())
-			return ID(escaped + ":" + string(id)), err
+			if err != nil {
+				return NIL, err
+			}
+			escaped += ":" + string(id)
+		}
+
+		if d.factory.threshold == 0 || len(value) <= d.factory.threshold {
+			return ID(escaped), nil
 		}
+
+		id := d.factory.hashLiteral(escaped)
+		if _, has := d.values[id]; !has && d.update {
+			key := make([]byte, 1+len(id))
+			key[0] = IDToValuePrefix
+			copy(key[1:], id)
+			var err error
+			d.txn, err = setSafe(key, []byte(escaped), d.txn, d.factory.db)
+			if err != nil {
+				return NIL, err
+			}
+			d.values[id] = escaped
+		}
+		return ID(id), nil
 	case *rdf.DefaultGraph:
 		id, err := d.getIRI(base)
 		if err != nil {
@@ -297,6 +353,15 @@ func (d *iriDictionary) GetTerm(id ID, origin rdf.Term) (rdf.Term, error) {
 
 	s := string(id)
 
+	// Hashed literal?
+	if len(s) > 0 && s[0] == HashPrefix {
+		value, err := d.getValue(iri(s))
+		if err != nil {
+			return nil, err
+		}
+		return d.GetTerm(ID(value), origin)
+	}
+
 	// Literal?
 	li := patternLiteral.FindStringIndex(s)
 	if li != nil && li[0] == 0 {
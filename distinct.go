@@ -0,0 +1,43 @@
+package styx
+
+import (
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// QueryDistinct returns the distinct values of the given variables over all of
+// the pattern's solutions, like SELECT DISTINCT. The variables are put first in
+// the iterator's domain, so the solver enumerates their combinations in order and
+// Next can skip straight to the next combination instead of walking the solutions
+// in between. This means no seen-set is kept: the memory cost is the result itself.
+func (s *Store) QueryDistinct(pattern []*rdf.Quad, projection []rdf.Term) ([][]rdf.Term, error) {
+	if len(projection) == 0 {
+		return nil, ErrInvalidDomain
+	}
+
+	iter, err := s.Query(pattern, projection, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	if iter.empty || iter.top {
+		return [][]rdf.Term{}, nil
+	}
+
+	last := projection[len(projection)-1]
+	result := [][]rdf.Term{}
+	for {
+		d, err := iter.Next(last)
+		if err != nil {
+			return nil, err
+		} else if d == nil {
+			return result, nil
+		}
+
+		index := make([]rdf.Term, len(projection))
+		for i, node := range projection {
+			index[i] = iter.Get(node)
+		}
+		result = append(result, index)
+	}
+}
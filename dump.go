@@ -0,0 +1,63 @@
+package styx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// Dump writes every statement in the database to w as N-Quads, in index order.
+// Each line is a triple of the subject-predicate-object index with the graph of one of
+// its statements, resolved the same way as Iterator.Prov: blank nodes are written as
+// their skolem IRIs and the default graph of a dataset as the dataset's URI with an empty fragment.
+func (s *Store) Dump(w io.Writer) error {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	prefix := []byte{s.Config.Prefixes.Ternary[SPO]}
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: true, Prefix: prefix})
+	defer iter.Close()
+
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		key := item.Key()
+		ids := strings.Split(string(key[1:]), "\t")
+		if len(ids) != 3 {
+			return fmt.Errorf("Unexpected ternary key: %v", key)
+		}
+
+		terms := [3]rdf.Term{}
+		for i, id := range ids {
+			term, err := dictionary.GetTerm(ID(id), rdf.Default)
+			if err != nil {
+				return err
+			}
+			terms[i] = term
+		}
+
+		var statements []*Statement
+		err := item.Value(func(val []byte) (err error) {
+			statements, err = getStatements(val)
+			return
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range statements {
+			quad := rdf.NewQuad(terms[0], terms[1], terms[2], statement.Graph(dictionary))
+			_, err = fmt.Fprintln(w, quad.String())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package styx
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/google/uuid"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// An Executor bounds the number of queries that are open on a store at once.
+// Every open Iterator holds a Badger read transaction and one Badger iterator
+// per constraint, so a burst of unbounded queries can exhaust them; the Executor
+// makes queries beyond its concurrency wait in a queue until an iterator is closed,
+// and rejects them outright once the queue is full.
+type Executor struct {
+	store    *Store
+	slots    chan struct{}
+	capacity int64
+	queued   int64
+	rejected int64
+	lock     sync.Mutex
+	queries  map[string]*query
+}
+
+type query struct {
+	pattern []*rdf.Quad
+	started time.Time
+	iter    *Iterator
+	cancel  context.CancelFunc
+}
+
+// QueryInfo describes a query that an Executor is running
+type QueryInfo struct {
+	ID        string
+	Pattern   []*rdf.Quad
+	Elapsed   time.Duration
+	Solutions int // The number of solutions returned so far
+}
+
+// ExecutorStats is a snapshot of an Executor's activity
+type ExecutorStats struct {
+	Active   int   // The number of open iterators
+	Queued   int   // The number of queries waiting for an iterator to close
+	Rejected int64 // The total number of queries rejected because the queue was full
+}
+
+// NewExecutor returns an Executor that runs at most concurrency queries at once
+// and queues at most queue more.
+func (s *Store) NewExecutor(concurrency, queue int) *Executor {
+	return &Executor{
+		store:    s,
+		slots:    make(chan struct{}, concurrency),
+		capacity: int64(queue),
+		queries:  map[string]*query{},
+	}
+}
+
+// Query waits for a free slot and then calls Query on the store.
+// The slot is released when the returned iterator is closed, so callers must always close it.
+// If the queue is full, Query returns ErrQueueFull without waiting;
+// if the context is done while waiting, it returns the context's error.
+// Once the query is running, cancelling the context (or calling Cancel)
+// makes the iterator's Next return the context's error.
+func (e *Executor) Query(ctx context.Context, pattern []*rdf.Quad, domain []rdf.Term, index []rdf.Term) (*Iterator, error) {
+	select {
+	case e.slots <- struct{}{}:
+	default:
+		if atomic.AddInt64(&e.queued, 1) > e.capacity {
+			atomic.AddInt64(&e.queued, -1)
+			atomic.AddInt64(&e.rejected, 1)
+			return nil, ErrQueueFull
+		}
+
+		select {
+		case e.slots <- struct{}{}:
+			atomic.AddInt64(&e.queued, -1)
+		case <-ctx.Done():
+			atomic.AddInt64(&e.queued, -1)
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	iter, err := e.store.QueryContext(ctx, pattern, domain, index)
+	if err != nil {
+		cancel()
+		<-e.slots
+		return nil, err
+	}
+
+	id := uuid.New().String()
+	iter.release = func() {
+		cancel()
+		e.lock.Lock()
+		delete(e.queries, id)
+		e.lock.Unlock()
+		<-e.slots
+	}
+
+	e.lock.Lock()
+	e.queries[id] = &query{pattern: pattern, started: time.Now(), iter: iter, cancel: cancel}
+	e.lock.Unlock()
+
+	return iter, nil
+}
+
+// Stats returns the executor's current queue depth, active queries, and rejections
+func (e *Executor) Stats() ExecutorStats {
+	return ExecutorStats{
+		Active:   len(e.slots),
+		Queued:   int(atomic.LoadInt64(&e.queued)),
+		Rejected: atomic.LoadInt64(&e.rejected),
+	}
+}
+
+// ActiveQueries lists the queries whose iterators are open, oldest first
+func (e *Executor) ActiveQueries() []QueryInfo {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	now := time.Now()
+	queries := make([]QueryInfo, 0, len(e.queries))
+	for id, q := range e.queries {
+		queries = append(queries, QueryInfo{
+			ID:        id,
+			Pattern:   q.pattern,
+			Elapsed:   now.Sub(q.started),
+			Solutions: int(atomic.LoadInt64(&q.iter.count)),
+		})
+	}
+
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Elapsed > queries[j].Elapsed })
+	return queries
+}
+
+// Cancel cancels the context of a running query, so that its next call to Next
+// returns context.Canceled. The query keeps its slot until its iterator is closed.
+// Cancel returns false if there is no active query with the given id.
+func (e *Executor) Cancel(id string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	q, has := e.queries[id]
+	if has {
+		q.cancel()
+	}
+	return has
+}
@@ -0,0 +1,158 @@
+package styx
+
+import (
+	"strings"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// A valueFilter compares the value of the variable at index with
+// either a constant term or the value of the variable at other
+type valueFilter struct {
+	index    int
+	operator string
+	value    rdf.Term
+	other    int
+}
+
+// compareTerms orders two terms: numeric literals by their numeric value,
+// xsd:date and xsd:dateTime literals by time (in UTC), and other literals and IRIs
+// lexicographically by their values. ok is false if the terms aren't comparable,
+// e.g. a number and a date, a literal and an IRI, or a malformed date and anything.
+func compareTerms(a, b rdf.Term) (result int, ok bool) {
+	x, xt, xok := parseOrdered(a)
+	y, yt, yok := parseOrdered(b)
+	if xok && yok {
+		if xt != yt {
+			return 0, false
+		} else if xt {
+			s, _, _ := parseTemporal(a)
+			t, _, _ := parseTemporal(b)
+			if s.Before(t) {
+				return -1, true
+			} else if s.After(t) {
+				return 1, true
+			}
+			return 0, true
+		} else if x < y {
+			return -1, true
+		} else if x > y {
+			return 1, true
+		}
+		return 0, true
+	} else if xok || yok || a.TermType() != b.TermType() {
+		return 0, false
+	} else if _, is, _ := parseTemporal(a); is {
+		// Malformed dates aren't comparable to anything
+		return 0, false
+	} else if _, is, _ := parseTemporal(b); is {
+		return 0, false
+	}
+
+	switch a.TermType() {
+	case rdf.LiteralType, rdf.NamedNodeType:
+		return strings.Compare(a.Value(), b.Value()), true
+	default:
+		return 0, false
+	}
+}
+
+// test applies a comparison operator to two terms. Equality of terms that aren't
+// both numbers or dates is exact term equality, and the ordering operators
+// are false for terms that aren't comparable.
+func test(operator string, a, b rdf.Term) bool {
+	result, ok := compareTerms(a, b)
+	switch operator {
+	case "=":
+		if ok && isOrdered(a) {
+			return result == 0
+		}
+		return a.Equal(b)
+	case "!=":
+		if ok && isOrdered(a) {
+			return result != 0
+		}
+		return !a.Equal(b)
+	case "<":
+		return ok && result < 0
+	case "<=":
+		return ok && result <= 0
+	case ">":
+		return ok && result > 0
+	case ">=":
+		return ok && result >= 0
+	default:
+		return false
+	}
+}
+
+// isOrdered checks whether a term is a number or a date
+func isOrdered(term rdf.Term) bool {
+	_, _, ok := parseOrdered(term)
+	return ok
+}
+
+// Filter makes Next skip solutions where comparing the value of the given variable
+// with the value doesn't hold. The operator is one of =, !=, <, <=, >, and >=.
+// The value is either a constant term or another variable of the domain.
+// Numbers compare numerically across numeric datatypes (so "1"^^xsd:integer = "1.0"^^xsd:decimal),
+// dates and dateTimes compare in time, and other literals and IRIs compare lexicographically.
+// Terms that can't be ordered against each other fail every ordering operator,
+// and solutions with malformed dates fail every filter and are logged to Config.Logger.
+// Like Range, filters are applied to the solutions that the constraint graph produces.
+func (iter *Iterator) Filter(node rdf.Term, operator string, value rdf.Term) error {
+	if iter.empty {
+		return nil
+	}
+
+	switch operator {
+	case "=", "!=", "<", "<=", ">", ">=":
+	default:
+		return ErrInvalidFilter
+	}
+
+	index, has := iter.ids[node.String()]
+	if !has {
+		return ErrInvalidDomain
+	}
+
+	if _, is, ok := parseTemporal(value); is && !ok {
+		return ErrInvalidFilter
+	}
+
+	f := valueFilter{index: index, operator: operator, value: value, other: -1}
+	if value.TermType() == rdf.VariableType || value.TermType() == rdf.BlankNodeType {
+		if f.other, has = iter.ids[value.String()]; !has {
+			return ErrInvalidDomain
+		}
+	}
+
+	iter.filters = append(iter.filters, f)
+	return nil
+}
+
+// passes checks the current solution against iter.filters
+func (iter *Iterator) passes() (bool, error) {
+	for _, f := range iter.filters {
+		term, err := iter.dictionary.GetTerm(iter.variables[f.index].value, rdf.Default)
+		if err != nil {
+			return false, err
+		}
+
+		value := f.value
+		if f.other != -1 {
+			value, err = iter.dictionary.GetTerm(iter.variables[f.other].value, rdf.Default)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if iter.malformed(term) || (f.other != -1 && iter.malformed(value)) {
+			return false, nil
+		} else if !test(f.operator, term, value) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,61 @@
+package styx
+
+import (
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// Graphs makes Next skip solutions that use a quad that isn't asserted in any
+// of the given graphs. Graphs are named as Prov reports them: named graphs by their IRI,
+// and blank graphs by the skolem IRI <dataset#label>. rdf.Default selects the default
+// graph of every dataset, and <dataset#> selects the default graph of just that one.
+// Quads of the pattern without any variables aren't checked.
+// Calling Graphs with no graphs removes the restriction.
+func (iter *Iterator) Graphs(graphs ...rdf.Term) {
+	iter.graphs = nil
+	if len(graphs) == 0 {
+		return
+	}
+
+	iter.graphs = make(map[string]bool, len(graphs))
+	for _, graph := range graphs {
+		iter.graphs[graph.String()] = true
+	}
+}
+
+// inGraphs checks the current solution against iter.graphs
+func (iter *Iterator) inGraphs() (bool, error) {
+	statements, err := iter.statements()
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range statements {
+		if s == nil {
+			continue
+		}
+
+		ok := false
+		for _, statement := range s {
+			graph := statement.Graph(iter.dictionary)
+			if iter.graphs[graph.String()] {
+				ok = true
+			} else if iter.graphs[rdf.Default.String()] {
+				base, err := iter.dictionary.GetTerm(ID(statement.base), rdf.Default)
+				if err != nil {
+					return false, err
+				}
+				ok = graph.Value() == base.Value()+"#"
+			}
+
+			if ok {
+				break
+			}
+		}
+
+		if !ok {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
@@ -1,11 +1,15 @@
 package styx
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 	"text/tabwriter"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 	rdf "github.com/underlay/go-rdfjs"
@@ -18,10 +22,23 @@ type Iterator struct {
 	variables  []*variable
 	domain     []rdf.Term
 	pivot      int
+	limit      int
+	offset     int
+	skipped    int
+	sources    int
+	filters    []valueFilter
+	graphs     map[string]bool
+	languages  map[int]string
+	lead       bool
+	count      int64
+	ctx        context.Context
+	deadline   time.Time
+	expired    bool
 	bot        bool
 	top        bool
 	empty      bool
 	ids        map[string]int
+	duplicates map[int]int
 	cache      []*vcache
 	blacklist  []bool
 	in         [][]int
@@ -29,30 +46,97 @@ type Iterator struct {
 	binary     binaryCache
 	unary      unaryCache
 	tag        TagScheme
+	prefixes   *Prefixes
+	logger     Logger
+	metrics    Metrics
+	started    time.Time
+	planning   time.Duration
+	solutions  int64
+	release    func()
+	borrowed   bool // Whether txn and dictionary belong to the caller of Store.query
 	txn        *badger.Txn
 	dictionary Dictionary
 }
 
 // Collect calls Next(nil) on the iterator until there are no more solutions,
-// and returns all the results in a slice.
+// and returns all the results in a slice. Each result is a full index,
+// ordered the same as the iterator's domain.
+// If the iterator's timeout elapses, the results found so far
+// are returned along with ErrTimeout.
 func (iter *Iterator) Collect() ([][]rdf.Term, error) {
 	if iter.empty {
 		return nil, nil
 	}
 
 	result := [][]rdf.Term{}
-	for d, err := iter.Next(nil); d != nil; d, err = iter.Next(nil) {
+	for {
+		d, err := iter.Next(nil)
+		if err == ErrTimeout {
+			return result, err
+		} else if err != nil {
+			return nil, err
+		} else if d == nil {
+			return result, nil
+		}
+
+		result = append(result, iter.Index())
+	}
+}
+
+// CollectContext is like Collect, except that it stops early if the context is done.
+// If the context's deadline expires, the solutions found so far are returned
+// along with partial = true instead of an error; if the context is cancelled
+// for any other reason its error is returned as usual.
+// The context takes the place of the iterator's own (from QueryContext) while
+// collecting, and it's checked every time a variable advances, so it also interrupts
+// a single slow join. Either way the iterator can't be advanced afterwards.
+func (iter *Iterator) CollectContext(ctx context.Context) (result [][]rdf.Term, partial bool, err error) {
+	if iter.empty {
+		return nil, false, nil
+	}
+
+	previous := iter.ctx
+	iter.ctx = ctx
+	defer func() { iter.ctx = previous }()
+
+	result = [][]rdf.Term{}
+	for {
+		d, err := iter.Next(nil)
+		if err == context.DeadlineExceeded {
+			return result, true, nil
+		} else if err != nil {
+			return nil, false, err
+		} else if d == nil {
+			return result, false, nil
+		}
+
+		result = append(result, iter.Index())
+	}
+}
+
+// project collects the remaining results like Collect, except that each result
+// is ordered by the given domain instead of by the iterator's own domain,
+// so that the results of several iterators can be combined.
+func (iter *Iterator) project(domain []rdf.Term) ([][]rdf.Term, error) {
+	if iter.empty {
+		return nil, nil
+	}
+
+	result := [][]rdf.Term{}
+	for {
+		d, err := iter.Next(nil)
 		if err != nil {
 			return nil, err
+		} else if d == nil {
+			return result, nil
 		}
 
-		index := make([]rdf.Term, len(d))
-		for i, b := range d {
-			index[i] = iter.Get(b)
+		index := make([]rdf.Term, len(domain))
+		for i, node := range domain {
+			index[i] = iter.Get(node)
 		}
 		result = append(result, index)
 	}
-	return result, nil
 }
 
 // Log pretty-prints the iterator
@@ -115,26 +199,78 @@ func (iter *Iterator) variate(term rdf.Term) rdf.Term {
 
 // Prov returns a matrix of graph sources
 func (iter *Iterator) Prov() ([][]rdf.Term, error) {
-	ids := make([][]rdf.Term, len(iter.query))
-	for _, u := range iter.variables {
-		for _, c := range u.cs {
-			if ids[c.index] == nil &&
-				TernaryPrefixes[0] <= c.prefix[0] &&
-				c.prefix[0] <= TernaryPrefixes[2] {
-				statements, err := c.Sources(u.value, iter.txn)
+	statements, err := iter.statements()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][]rdf.Term, len(statements))
+	for i, s := range statements {
+		if s != nil {
+			ids[i] = make([]rdf.Term, len(s))
+			for j, statement := range s {
+				ids[i][j] = statement.Graph(iter.dictionary)
+			}
+		}
+	}
+
+	return ids, nil
+}
+
+// Sources returns a matrix of the datasets that each quad of the current result
+// was inserted with, to use with Metadata
+func (iter *Iterator) Sources() ([][]rdf.Term, error) {
+	statements, err := iter.statements()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][]rdf.Term, len(statements))
+	for i, s := range statements {
+		if s != nil {
+			ids[i] = make([]rdf.Term, len(s))
+			for j, statement := range s {
+				ids[i][j], err = iter.dictionary.GetTerm(ID(statement.base), rdf.Default)
 				if err != nil {
 					return nil, err
 				}
+			}
+		}
+	}
+
+	return ids, nil
+}
 
-				ids[c.index] = make([]rdf.Term, len(statements))
-				for i, statement := range statements {
-					ids[c.index][i] = statement.Graph(iter.dictionary)
+// Metadata returns the metadata of a dataset (e.g. one from Sources)
+// as of the iterator's snapshot of the database
+func (iter *Iterator) Metadata(dataset rdf.Term) ([]byte, error) {
+	origin, err := iter.dictionary.GetID(dataset, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+	return getMetadata(origin, iter.prefixes, iter.txn)
+}
+
+// statements returns the statements of each quad of the current result
+func (iter *Iterator) statements() ([][]*Statement, error) {
+	statements := make([][]*Statement, len(iter.query))
+	for _, u := range iter.variables {
+		for _, c := range u.cs {
+			if statements[c.index] == nil && bytes.IndexByte(iter.prefixes.Ternary[:], c.prefix[0]) != -1 {
+				s, err := c.Sources(u.value, iter.prefixes.Ternary[0], iter.txn)
+				if err != nil {
+					return nil, err
 				}
+				statements[c.index] = s
 			}
 		}
 	}
 
-	return ids, nil
+	for i, j := range iter.duplicates {
+		statements[i] = statements[j]
+	}
+
+	return statements, nil
 }
 
 // Get the value for a particular blank node
@@ -191,6 +327,157 @@ func (iter *Iterator) Index() []rdf.Term {
 	return index
 }
 
+// Limit bounds the number of results that Next will return after the most recent Seek.
+// Once the limit is reached, Next returns nil without advancing any of the variables,
+// so the leading scan stops early instead of enumerating and discarding the remaining results.
+// A limit of zero means no limit.
+func (iter *Iterator) Limit(limit int) {
+	iter.limit = limit
+}
+
+// Offset makes Next skip the given number of results after the most recent Seek,
+// without resolving their terms. The skipped results don't count toward the limit,
+// and an offset past the last result just leaves the iterator exhausted.
+func (iter *Iterator) Offset(offset int) {
+	iter.offset = offset
+}
+
+// Timeout makes Next return ErrTimeout once the given duration has passed.
+// Like the context of QueryContext, the timeout is checked every time a variable
+// advances, so it also interrupts a single slow join.
+// The iterator can't be advanced after it times out, but its previous results are
+// still valid, and it still has to be closed.
+func (iter *Iterator) Timeout(timeout time.Duration) {
+	iter.deadline = time.Now().Add(timeout)
+}
+
+// interrupted returns the error of the iterator's context if it's done,
+// or ErrTimeout if the deadline set by Timeout has passed.
+// A done context also closes the constraints' cursors, since the iterator
+// can't be advanced again, so that a cancelled query releases them right away.
+func (iter *Iterator) interrupted() error {
+	if iter.ctx != nil {
+		if err := iter.ctx.Err(); err != nil {
+			for _, u := range iter.variables {
+				u.Close()
+			}
+			return err
+		}
+	}
+
+	if iter.timedOut() {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// timedOut checks the deadline set by Timeout
+func (iter *Iterator) timedOut() bool {
+	if !iter.expired && !iter.deadline.IsZero() && time.Now().After(iter.deadline) {
+		iter.expired = true
+	}
+	return iter.expired
+}
+
+// MinSources makes Next skip solutions that use a quad asserted by fewer than
+// the given number of distinct datasets, so that only corroborated results are returned.
+// Quads of the pattern without any variables aren't checked.
+// A minimum of zero (or one) means every solution is returned.
+func (iter *Iterator) MinSources(sources int) {
+	iter.sources = sources
+}
+
+// Language makes Next skip solutions where the value of the given variable isn't
+// a literal with the given language tag (compared case-insensitively).
+// An empty tag only accepts literals without a language tag.
+// Variables without a language stay unconstrained.
+func (iter *Iterator) Language(node rdf.Term, language string) error {
+	if iter.empty {
+		return nil
+	}
+
+	index, has := iter.ids[node.String()]
+	if !has {
+		return ErrInvalidDomain
+	}
+
+	if iter.languages == nil {
+		iter.languages = map[int]string{}
+	}
+
+	iter.languages[index] = language
+	return nil
+}
+
+// filtered returns whether Next has to check solutions with accept
+func (iter *Iterator) filtered() bool {
+	return iter.sources > 1 || len(iter.languages) > 0 || len(iter.filters) > 0 || iter.graphs != nil
+}
+
+// accept checks the current solution against iter.sources, iter.graphs, iter.languages, and iter.filters
+func (iter *Iterator) accept() (bool, error) {
+	if iter.sources > 1 {
+		ok, err := iter.corroborated()
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+
+	if iter.graphs != nil {
+		ok, err := iter.inGraphs()
+		if err != nil || !ok {
+			return ok, err
+		}
+	}
+
+	for index, language := range iter.languages {
+		term, err := iter.dictionary.GetTerm(iter.variables[index].value, rdf.Default)
+		if err != nil {
+			return false, err
+		}
+
+		literal, is := term.(*rdf.Literal)
+		if !is || !strings.EqualFold(literal.Language(), language) {
+			return false, nil
+		}
+	}
+
+	return iter.passes()
+}
+
+// corroborated checks the current solution against iter.sources
+func (iter *Iterator) corroborated() (bool, error) {
+	statements, err := iter.statements()
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range statements {
+		if s == nil {
+			continue
+		}
+
+		datasets := make(map[iri]bool, len(s))
+		for _, statement := range s {
+			datasets[statement.base] = true
+		}
+
+		if len(datasets) < iter.sources {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// FirstPerLead makes Next(nil) return only the first solution for each value
+// of the iterator's leading variable (the first term of Domain()).
+// After each solution the leading variable is advanced directly,
+// skipping the rest of the current value's subtree without enumerating it.
+func (iter *Iterator) FirstPerLead(first bool) {
+	iter.lead = first
+}
+
 // Next advances the iterator to the next result that differs in the given node.
 // If nil is passed, the last node in the domain is used.
 func (iter *Iterator) Next(node rdf.Term) ([]rdf.Term, error) {
@@ -198,9 +485,73 @@ func (iter *Iterator) Next(node rdf.Term) ([]rdf.Term, error) {
 		return nil, nil
 	}
 
+	if err := iter.interrupted(); err != nil {
+		return nil, err
+	}
+
+	if iter.limit > 0 && atomic.LoadInt64(&iter.count) >= int64(iter.limit) {
+		iter.top = true
+		return nil, nil
+	}
+
+	tail, err := iter.step(node)
+	if err != nil {
+		return nil, err
+	}
+
+	// Skip the first iter.offset results without resolving their terms
+	l := iter.Len()
+	for tail < l && iter.skipped < iter.offset {
+		iter.skipped++
+		t, err := iter.step(nil)
+		if err != nil {
+			return nil, err
+		} else if t == l || t < tail {
+			tail = t
+		}
+	}
+
+	if tail == l {
+		iter.top = true
+		return nil, nil
+	}
+
+	result := make([]rdf.Term, l-tail)
+	for i, u := range iter.variables[tail:] {
+		result[i], _ = iter.dictionary.GetTerm(u.value, rdf.Default)
+	}
+
+	atomic.AddInt64(&iter.count, 1)
+	iter.solutions++
+	return result, nil
+}
+
+// step advances the iterator to its next result that accept accepts,
+// returning the index of the first variable that changed (zero for the
+// first result after a Seek) or Len() if there are no more results.
+func (iter *Iterator) step(node rdf.Term) (int, error) {
+	l := iter.Len()
+
+	filtered := iter.filtered()
+
+	// If the first result after a Seek isn't accepted,
+	// the whole index of the next one is returned.
+	skipped := false
 	if iter.bot {
 		iter.bot = false
-		return iter.Index(), nil
+		ok := !filtered
+		if !ok {
+			var err error
+			if ok, err = iter.accept(); err != nil {
+				return l, err
+			}
+		}
+
+		if ok {
+			return 0, nil
+		}
+
+		node, skipped = nil, true
 	}
 
 	i := iter.pivot - 1
@@ -211,26 +562,37 @@ func (iter *Iterator) Next(node rdf.Term) ([]rdf.Term, error) {
 			i = index
 		}
 	} else if iter.pivot == 0 {
-		return nil, nil
+		return l, nil
+	} else if iter.lead {
+		i = 0
 	}
 
 	tail, err := iter.next(i)
 	if err != nil {
-		return nil, err
+		return l, err
 	}
 
-	l := iter.Len()
-	if tail == l {
-		iter.top = true
-		return nil, nil
+	for filtered && tail < l {
+		ok, err := iter.accept()
+		if err != nil {
+			return l, err
+		} else if ok {
+			break
+		}
+
+		t, err := iter.next(iter.pivot - 1)
+		if err != nil {
+			return l, err
+		} else if t == l || t < tail {
+			tail = t
+		}
 	}
 
-	result := make([]rdf.Term, l-tail)
-	for i, u := range iter.variables[tail:] {
-		result[i], _ = iter.dictionary.GetTerm(u.value, rdf.Default)
+	if skipped && tail < l {
+		tail = 0
 	}
 
-	return result, nil
+	return tail, nil
 }
 
 // Seek advances the iterator to the first result
@@ -238,10 +600,14 @@ func (iter *Iterator) Next(node rdf.Term) ([]rdf.Term, error) {
 func (iter *Iterator) Seek(index []rdf.Term) (err error) {
 	if iter.empty {
 		return
+	} else if err = iter.interrupted(); err != nil {
+		return
 	}
 
 	iter.bot = true
 	iter.top = false
+	iter.skipped = 0
+	atomic.StoreInt64(&iter.count, 0)
 
 	terms := make([]ID, len(index))
 	for i, node := range index {
@@ -259,42 +625,31 @@ func (iter *Iterator) Seek(index []rdf.Term) (err error) {
 	}
 
 	for i, u := range iter.variables {
-		var root ID
+		// Variables that nothing is pushed to still have their cursors wherever
+		// the last Next left them, so every variable seeks back to its root
+		root := u.root
 		if i < len(terms) && u.root < terms[i] {
 			root = terms[i]
-		} else if u.value == NIL {
-			root = u.root
 		}
 
-		if root != NIL {
-			for u.value = u.Seek(root); u.value == NIL; u.value = u.Seek(root) {
-				ok, err = iter.tick(i, 0, iter.cache)
-				if err != nil || !ok {
-					return
-				}
-				if !ok {
-					iter.top = true
-					return
-				}
+		for u.value = u.Seek(root); u.value == NIL; u.value = u.Seek(root) {
+			ok, err = iter.tick(i, -1, iter.cache)
+			if err != nil {
+				return
+			} else if !ok {
+				iter.top = true
+				return
 			}
 		}
 
-		// We've got a non-nil value for u!
+		// We've got a non-nil value for u! The variables that tick changed
+		// on the way have already been pushed to u and the rest of the domain,
+		// and pushing them again would clear u's value.
+		clear(iter.cache[:i])
 		err = iter.push(u, i, l)
 		if err != nil {
 			return err
 		}
-		for j, saved := range iter.cache[:i] {
-			if saved != nil {
-				iter.cache[j] = nil
-				if i+1 < l {
-					err = iter.push(iter.variables[j], i, l)
-					if err != nil {
-						return err
-					}
-				}
-			}
-		}
 	}
 
 	return
@@ -303,24 +658,77 @@ func (iter *Iterator) Seek(index []rdf.Term) (err error) {
 // Close the iterator
 func (iter *Iterator) Close() {
 	if iter != nil {
+		if iter.logger != nil {
+			iter.logStats()
+		}
+		iter.observe()
 		if iter.variables != nil {
 			for _, u := range iter.variables {
 				u.Close()
 			}
 		}
-		if iter.txn != nil {
+		if iter.txn != nil && !iter.borrowed {
 			iter.txn.Discard()
 		}
-		if iter.dictionary != nil {
+		if iter.dictionary != nil && !iter.borrowed {
 			iter.dictionary.Commit()
 		}
+		if iter.release != nil {
+			iter.release()
+			iter.release = nil
+		}
+	}
+}
+
+// logStats reports which index each constraint counted with and scanned,
+// and how many cursor reads the scan took
+func (iter *Iterator) logStats() {
+	for _, u := range iter.variables {
+		for _, c := range u.cs {
+			if len(c.prefix) == 0 {
+				continue
+			} else if c.kind != 0 {
+				iter.logger.Printf(
+					"%s in range: scanned %c values with %d reads\n",
+					u.node.String(), c.kind, c.reads,
+				)
+				continue
+			}
+
+			scan := "binary"
+			if bytes.IndexByte(iter.prefixes.Ternary[:], c.prefix[0]) != -1 {
+				scan = "ternary"
+			} else if c.prefix[0] == iter.prefixes.Unary {
+				scan = "unary"
+			}
+
+			count := "none"
+			if c.counter == iter.prefixes.Unary {
+				count = "unary"
+			} else if c.counter != 0 {
+				count = "binary " + string(c.counter)
+			}
+
+			iter.logger.Printf(
+				"%s in triple %d: count %d from %s, scanned %s %s with %d reads\n",
+				u.node.String(), c.index, c.count, count, scan, string(c.prefix[0]), c.reads,
+			)
+		}
 	}
 }
 
 func (iter *Iterator) String() string {
 	s := "----- Constraint Graph -----\n"
+	if iter.empty {
+		s += fmt.Sprintln("Empty: a constraint has no matches")
+	}
+	s += fmt.Sprintf("Pivot: %d\n", iter.pivot)
 	for i, id := range iter.domain {
-		s += fmt.Sprintf("---- %s ----\n%s\n", id, iter.variables[i].String())
+		s += fmt.Sprintf("---- %d: %s ----\n%s", i, id, iter.variables[i].String())
+		if i < len(iter.in) {
+			s += fmt.Sprintf("In: %v\nOut: %v\n", iter.in[i], iter.out[i])
+		}
+		s += "\n"
 	}
 	s += fmt.Sprintln("----- End of Constraint Graph -----")
 	return s
@@ -337,10 +745,9 @@ func (iter *Iterator) Swap(a, b int) {
 	iter.domain[a], iter.domain[b] = iter.domain[b], iter.domain[a]
 }
 
-// TODO: put more thought into the sorting heuristic.
-// Right now the variables are sorted their norm: in
-// increasing order of their length-normalized sum of
-// the squares of the counts of all their constraints (of any degree).
+// The variables are sorted in increasing order of their score,
+// which is Config.Score (by default NormScore) of the counts
+// of all their constraints (of any degree).
 func (iter *Iterator) Less(a, b int) bool {
 	// So pivot right now is the length of the provided domain.
 	// We keep those in order...
@@ -376,7 +783,8 @@ func (iter *Iterator) insertDZ(u *variable, c *constraint, txn *badger.Txn) (err
 	}
 
 	p := (c.place + 2) % 3
-	c.prefix = assembleKey(BinaryPrefixes[p], true, c.terms[p])
+	c.prefix = assembleKey(iter.prefixes.Binary[p], true, c.terms[p])
+	c.txn, c.major = txn, iter.prefixes.Ternary[SPO]
 
 	// Create a new badger.Iterator for the constraint
 	c.iterator = txn.NewIterator(badger.IteratorOptions{
@@ -403,7 +811,7 @@ func (iter *Iterator) insertD1(u *variable, c *constraint, txn *badger.Txn) (err
 
 	p := (c.place + 1) % 3
 	v, w := c.terms[p], c.terms[(p+1)%3]
-	c.prefix = assembleKey(TernaryPrefixes[p], true, v, w)
+	c.prefix = assembleKey(iter.prefixes.Ternary[p], true, v, w)
 
 	// Create a new badger.Iterator for the constraint
 	c.iterator = txn.NewIterator(badger.IteratorOptions{
@@ -449,7 +857,7 @@ func (iter *Iterator) insertD2(u, v *variable, c *constraint, txn *badger.Txn) (
 		p = ((c.place + 1) % 3) + 3
 	}
 
-	c.prefix = assembleKey(BinaryPrefixes[p], true, c.terms[p%3])
+	c.prefix = assembleKey(iter.prefixes.Binary[p], true, c.terms[p%3])
 
 	// Create a new badger.Iterator for the constraint
 	c.iterator = txn.NewIterator(badger.IteratorOptions{
@@ -460,6 +868,45 @@ func (iter *Iterator) insertD2(u, v *variable, c *constraint, txn *badger.Txn) (
 	return
 }
 
+func (iter *Iterator) insertD3(u *variable, vs [2]*variable, c *constraint, txn *badger.Txn) (err error) {
+	// Third-degree constraints start out scanning every term in the unary index.
+	// Whichever variable of the triple comes first keeps that scan, and pushing
+	// its value gives the others a binary prefix, and then a ternary one.
+	if u.edges == nil {
+		u.edges = constraintMap{}
+	}
+
+	for _, v := range vs {
+		j := iter.getIndex(v)
+		if cs, has := u.edges[j]; has {
+			u.edges[j] = append(cs, c)
+		} else {
+			u.edges[j] = constraintSet{c}
+		}
+	}
+
+	if u.cs == nil {
+		u.cs = constraintSet{c}
+	} else {
+		u.cs = append(u.cs, c)
+	}
+
+	c.count, err = c.getCount(iter.unary, iter.binary, txn)
+	if err != nil {
+		return
+	}
+
+	c.prefix = []byte{iter.prefixes.Unary}
+
+	// The prefix changes between index families as values are pushed,
+	// so the iterator can't be restricted to one of them
+	c.iterator = txn.NewIterator(badger.IteratorOptions{
+		PrefetchValues: false,
+	})
+
+	return
+}
+
 func (iter *Iterator) getIndex(u *variable) int {
 	for i, v := range iter.variables {
 		if u == v {
@@ -0,0 +1,464 @@
+package styx
+
+import (
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v2"
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// TopK returns, for every subject with a value for the given predicate,
+// the first k of its objects in index order, keyed by the subject's N-Triples string.
+// The subjects come from a single scan of the predicate-subject binary index,
+// and each subject's objects from a scan of the subject-predicate ternary index
+// that stops as soon as it has k of them.
+// Index order is the order of the terms' ids, which is only lexical with the string dictionary.
+// A negative k is ErrInvalidInput.
+func (s *Store) TopK(predicate rdf.Term, k int) (map[string][]rdf.Term, error) {
+	if k < 0 {
+		return nil, ErrInvalidInput
+	}
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	result := map[string][]rdf.Term{}
+
+	p, err := dictionary.GetID(predicate, rdf.Default)
+	if err == ErrNotFound {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	prefix := assembleKey(s.Config.Prefixes.Binary[PSO], true, p)
+	subjects := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer subjects.Close()
+
+	objects := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{s.Config.Prefixes.Ternary[SPO]}})
+	defer objects.Close()
+
+	for subjects.Seek(prefix); subjects.Valid(); subjects.Next() {
+		a := ID(subjects.Item().Key()[len(prefix):])
+		subject, err := dictionary.GetTerm(a, rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]rdf.Term, 0, k)
+		key := assembleKey(s.Config.Prefixes.Ternary[SPO], true, a, p)
+		for objects.Seek(key); objects.ValidForPrefix(key) && len(values) < k; objects.Next() {
+			object, err := dictionary.GetTerm(ID(objects.Item().Key()[len(key):]), rdf.Default)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, object)
+		}
+
+		result[subject.String()] = values
+	}
+
+	return result, nil
+}
+
+// Sources returns the datasets that assert the triple of the given quad,
+// one for each statement of it (so a dataset that asserts it in several graphs
+// appears more than once). The quad's graph is ignored.
+// Triples that aren't in the database have no sources.
+func (s *Store) Sources(quad *rdf.Quad) ([]rdf.Term, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	sources := []rdf.Term{}
+
+	ids := [3]ID{}
+	for i, term := range quad[:3] {
+		id, err := dictionary.GetID(term, rdf.Default)
+		if err == ErrNotFound {
+			return sources, nil
+		} else if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get(assembleKey(s.Config.Prefixes.Ternary[SPO], false, ids[:]...))
+	if err == badger.ErrKeyNotFound {
+		return sources, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var statements []*Statement
+	err = item.Value(func(val []byte) (err error) {
+		statements, err = getStatements(val)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, statement := range statements {
+		source, err := dictionary.GetTerm(ID(statement.base), rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+// Has returns whether any dataset asserts the triple of the given quad,
+// with a single read of its subject-predicate-object key. Like Sources,
+// it ignores the quad's graph. Blank nodes are addressed by their skolem IRIs,
+// and a quad with variables returns ErrInvalidInput.
+func (s *Store) Has(quad *rdf.Quad) (bool, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	ids := [3]ID{}
+	for i, term := range quad[:3] {
+		if term.TermType() == rdf.VariableType {
+			return false, ErrInvalidInput
+		}
+
+		id, err := dictionary.GetID(term, rdf.Default)
+		if err == ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		ids[i] = id
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	item, err := txn.Get(assembleKey(s.Config.Prefixes.Ternary[SPO], false, ids[:]...))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// A key without any statements doesn't assert anything
+	return item.ValueSize() > 0, nil
+}
+
+// HasProperty returns whether the subject has any value for the predicate,
+// with a single seek to the subject-predicate prefix of the ternary index
+// instead of listing the objects.
+func (s *Store) HasProperty(subject, predicate rdf.Term) (bool, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	ids := [2]ID{}
+	for i, term := range []rdf.Term{subject, predicate} {
+		id, err := dictionary.GetID(term, rdf.Default)
+		if err == ErrNotFound {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		ids[i] = id
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	prefix := assembleKey(s.Config.Prefixes.Ternary[SPO], true, ids[0], ids[1])
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer iter.Close()
+
+	iter.Seek(prefix)
+	return iter.ValidForPrefix(prefix), nil
+}
+
+// GetList follows the rdf:first / rdf:rest chain starting at head
+// and returns the members of the list in order. Blank list nodes are
+// addressed by their skolem IRIs, as they are returned from queries.
+// It returns ErrInvalidList if a node of the chain doesn't have exactly
+// the rdf:first and rdf:rest values it needs, or if the chain loops back on itself.
+func (s *Store) GetList(head rdf.Term) ([]rdf.Term, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	ids := [3]ID{}
+	for i, term := range []string{ld.RDFFirst, ld.RDFRest, ld.RDFNil} {
+		id, err := dictionary.GetID(rdf.NewNamedNode(term), rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+
+	first, rest, end := ids[0], ids[1], ids[2]
+	node, err := dictionary.GetID(head, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{s.Config.Prefixes.Ternary[SPO]}})
+	defer iter.Close()
+
+	list := []rdf.Term{}
+	visited := map[ID]bool{}
+	for node != end {
+		if visited[node] {
+			return nil, ErrInvalidList
+		}
+		visited[node] = true
+
+		value, err := getObject(iter, assembleKey(s.Config.Prefixes.Ternary[SPO], true, node, first))
+		if err != nil {
+			return nil, err
+		}
+
+		term, err := dictionary.GetTerm(value, rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, term)
+
+		node, err = getObject(iter, assembleKey(s.Config.Prefixes.Ternary[SPO], true, node, rest))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return list, nil
+}
+
+// getObject returns the last term of the only key with the given prefix
+func getObject(iter *badger.Iterator, prefix []byte) (ID, error) {
+	iter.Seek(prefix)
+	if !iter.ValidForPrefix(prefix) {
+		return NIL, ErrInvalidList
+	}
+
+	object := ID(iter.Item().Key()[len(prefix):])
+	if iter.Next(); iter.ValidForPrefix(prefix) {
+		return NIL, ErrInvalidList
+	}
+
+	return object, nil
+}
+
+// Relations returns every predicate p such that the triple (a p b) exists,
+// with a single scan of the object-subject-predicate index.
+// Opaque predicates aren't in that index, so each of them is
+// checked with a read of its subject-predicate-object key instead.
+func (s *Store) Relations(a, b rdf.Term) ([]rdf.Term, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	subject, err := dictionary.GetID(a, rdf.Default)
+	if err == ErrNotFound {
+		return []rdf.Term{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	object, err := dictionary.GetID(b, rdf.Default)
+	if err == ErrNotFound {
+		return []rdf.Term{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	prefix := assembleKey(s.Config.Prefixes.Ternary[OSP], true, object, subject)
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer iter.Close()
+
+	predicates := []rdf.Term{}
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		predicate, err := dictionary.GetTerm(ID(iter.Item().Key()[len(prefix):]), rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		predicates = append(predicates, predicate)
+	}
+
+	for _, predicate := range s.Config.OpaquePredicates {
+		p, err := dictionary.GetID(predicate, rdf.Default)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		item, err := txn.Get(assembleKey(s.Config.Prefixes.Ternary[SPO], false, subject, p, object))
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if item.ValueSize() > 0 {
+			predicates = append(predicates, predicate)
+		}
+	}
+
+	return predicates, nil
+}
+
+// WithObject returns every triple that has the given object,
+// with a single scan of the object's prefix of the object-subject-predicate index.
+// The triples are returned in the default graph, since a triple can be asserted in
+// several graphs; use Query and Prov to find where each one came from.
+// Opaque predicates aren't in that index, so their triples are found by reading
+// the subject-predicate-object key of every subject that has a value for one of them,
+// which is as slow as there are such subjects.
+func (s *Store) WithObject(object rdf.Term) ([]*rdf.Quad, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	quads := []*rdf.Quad{}
+
+	o, err := dictionary.GetID(object, rdf.Default)
+	if err == ErrNotFound {
+		return quads, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	prefix := assembleKey(s.Config.Prefixes.Ternary[OSP], true, o)
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer iter.Close()
+
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		ids := strings.Split(string(iter.Item().Key()[len(prefix):]), "\t")
+		if len(ids) != 2 {
+			return nil, ErrInvalidInput
+		}
+
+		terms := [2]rdf.Term{}
+		for i, id := range ids {
+			terms[i], err = dictionary.GetTerm(ID(id), rdf.Default)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		quads = append(quads, rdf.NewQuad(terms[0], terms[1], object, rdf.Default))
+	}
+
+	for _, predicate := range s.Config.OpaquePredicates {
+		p, err := dictionary.GetID(predicate, rdf.Default)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		prefix := assembleKey(s.Config.Prefixes.Binary[PSO], true, p)
+		subjects := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+		for subjects.Seek(prefix); subjects.Valid(); subjects.Next() {
+			a := ID(subjects.Item().Key()[len(prefix):])
+			item, err := txn.Get(assembleKey(s.Config.Prefixes.Ternary[SPO], false, a, p, o))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				subjects.Close()
+				return nil, err
+			} else if item.ValueSize() == 0 {
+				continue
+			}
+
+			subject, err := dictionary.GetTerm(a, rdf.Default)
+			if err != nil {
+				subjects.Close()
+				return nil, err
+			}
+
+			quads = append(quads, rdf.NewQuad(subject, predicate, object, rdf.Default))
+		}
+		subjects.Close()
+	}
+
+	return quads, nil
+}
+
+// Labels looks up a label (the first object of the given predicate, e.g. rdfs:label)
+// for every IRI in a set of results, like the ones returned by Collect.
+// The labels are keyed by IRI; IRIs without a label are left out.
+// All of the lookups share one transaction and one iterator,
+// which seeks through the subject-predicate index in key order.
+func (s *Store) Labels(results [][]rdf.Term, predicate rdf.Term) (map[string]rdf.Term, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	labels := map[string]rdf.Term{}
+
+	p, err := dictionary.GetID(predicate, rdf.Default)
+	if err == ErrNotFound {
+		return labels, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	iris := map[ID]string{}
+	for _, result := range results {
+		for _, term := range result {
+			if term == nil || term.TermType() != rdf.NamedNodeType {
+				continue
+			}
+
+			id, err := dictionary.GetID(term, rdf.Default)
+			if err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			iris[id] = term.Value()
+		}
+	}
+
+	// Seeking in key order lets one iterator serve every lookup
+	subjects := make(map[string]string, len(iris))
+	keys := make([]string, 0, len(iris))
+	for id, value := range iris {
+		key := string(assembleKey(s.Config.Prefixes.Ternary[SPO], true, id, p))
+		subjects[key] = value
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{s.Config.Prefixes.Ternary[SPO]}})
+	defer iter.Close()
+
+	for _, key := range keys {
+		prefix := []byte(key)
+		if iter.Seek(prefix); !iter.ValidForPrefix(prefix) {
+			continue
+		}
+
+		label, err := dictionary.GetTerm(ID(iter.Item().Key()[len(prefix):]), rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+
+		labels[subjects[key]] = label
+	}
+
+	return labels, nil
+}
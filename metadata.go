@@ -0,0 +1,63 @@
+package styx
+
+import (
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// SetMetadata attaches an opaque blob of application metadata (e.g. an ingestion time,
+// a trust score, or an uploader id) to a dataset, replacing any previous metadata.
+// Iterators expose it for the datasets of their results with Sources and Metadata,
+// and it's deleted along with the dataset. The dataset has to be in the quad store,
+// otherwise SetMetadata returns ErrNotFound instead of attaching metadata that
+// Delete would never reach.
+func (s *Store) SetMetadata(node rdf.Term, metadata []byte) error {
+	err := s.checkNode(node)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	origin, err := dictionary.GetID(node, rdf.Default)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.Config.QuadStore.Get(origin)
+	if err != nil {
+		return err
+	}
+
+	key := assembleKey(s.Config.Prefixes.Metadata, false, origin)
+	return s.Badger.Update(func(txn *badger.Txn) error { return txn.Set(key, metadata) })
+}
+
+// GetMetadata returns the metadata attached to a dataset, or ErrNotFound if there isn't any
+func (s *Store) GetMetadata(node rdf.Term) ([]byte, error) {
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	origin, err := dictionary.GetID(node, rdf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+	return getMetadata(origin, s.Config.Prefixes, txn)
+}
+
+func getMetadata(origin ID, prefixes *Prefixes, txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get(assembleKey(prefixes.Metadata, false, origin))
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
@@ -0,0 +1,46 @@
+package styx
+
+import (
+	"time"
+)
+
+// Metrics receives measurements of a store's writes and queries
+// (e.g. to export them to Prometheus). Its methods are called synchronously,
+// so they should return quickly. A nil Config.Metrics costs nothing.
+type Metrics interface {
+	// ObserveSet is called after every successful Set, SetMany, and Add
+	// with the number of quads they inserted and how long they took
+	ObserveSet(quads int, duration time.Duration)
+	// ObserveQuery is called when an iterator from Query is closed
+	ObserveQuery(stats QueryStats)
+}
+
+// QueryStats are the measurements of one query
+type QueryStats struct {
+	Planning  time.Duration // The time spent building and sorting the constraint graph
+	Duration  time.Duration // The time from the start of the query until its iterator was closed
+	Reads     int           // The number of cursor reads of all of the constraints
+	Solutions int           // The number of solutions that Next returned
+}
+
+// observe reports the iterator's stats to its metrics, once
+func (iter *Iterator) observe() {
+	if iter.metrics == nil {
+		return
+	}
+
+	stats := QueryStats{
+		Planning:  iter.planning,
+		Duration:  time.Since(iter.started),
+		Solutions: int(iter.solutions),
+	}
+
+	for _, u := range iter.variables {
+		for _, c := range u.cs {
+			stats.Reads += c.reads
+		}
+	}
+
+	iter.metrics.ObserveQuery(stats)
+	iter.metrics = nil
+}
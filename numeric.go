@@ -0,0 +1,97 @@
+package styx
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+var numericDatatypes = map[string]bool{
+	ld.XSDInteger: true,
+	ld.XSDDecimal: true,
+	ld.XSDDouble:  true,
+	ld.XSDFloat:   true,
+}
+
+// parseNumber returns the value of a literal with a numeric datatype
+func parseNumber(term rdf.Term) (float64, bool) {
+	literal, is := term.(*rdf.Literal)
+	if !is || literal.Datatype() == nil || !numericDatatypes[literal.Datatype().Value()] {
+		return 0, false
+	}
+
+	value, err := strconv.ParseFloat(strings.TrimSpace(literal.Value()), 64)
+	return value, err == nil
+}
+
+// QueryNumeric is like Query, except that numeric literals in the pattern match
+// every numeric literal in the database with the same value, regardless of its datatype
+// or lexical form: "22"^^xsd:integer also matches "22.0"^^xsd:decimal and "2.2e1"^^xsd:double.
+// This is looser than RDF term equality, which is why it isn't the default.
+//
+// Each numeric literal is replaced by a new variable that Iterator.Range limits
+// to the literal's value, so the matches come from the range index (see Range),
+// and the results are collected into a slice ordered by the given domain
+// (or by the pattern's variables in order of appearance if domain is nil).
+// NaN literals have no place in the range index, and only match themselves.
+func (s *Store) QueryNumeric(pattern []*rdf.Quad, domain []rdf.Term) ([][]rdf.Term, error) {
+	if domain == nil {
+		domain = getVariables(pattern)
+	}
+
+	// The new variables get labels that the pattern doesn't already use
+	used := map[string]bool{}
+	for _, variable := range getVariables(pattern) {
+		used[variable.Value()] = true
+	}
+
+	var n int
+	fresh := func() rdf.Term {
+		label := fmt.Sprintf("numeric%d", n)
+		for ; used[label]; label = fmt.Sprintf("numeric%d", n) {
+			n++
+		}
+		n++
+		return rdf.NewVariable(label)
+	}
+
+	// Copy the pattern so that we can substitute variables into it
+	query := make([]*rdf.Quad, len(pattern))
+	variables, literals := []rdf.Term{}, []rdf.Term{}
+	for i, quad := range pattern {
+		q := *quad
+		query[i] = &q
+		for p := 0; p < 3; p++ {
+			if value, is := parseNumber(quad[p]); is && !math.IsNaN(value) {
+				query[i][p] = fresh()
+				variables = append(variables, query[i][p])
+				literals = append(literals, quad[p])
+			}
+		}
+	}
+
+	iter, err := s.Query(query, domain, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	for i, variable := range variables {
+		err = iter.Range(variable, literals[i], literals[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := iter.project(domain)
+	if err != nil {
+		return nil, err
+	} else if result == nil {
+		return [][]rdf.Term{}, nil
+	}
+	return result, nil
+}
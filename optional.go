@@ -0,0 +1,143 @@
+package styx
+
+import (
+	"context"
+
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// QueryOptional solves the pattern and then left-joins each of the optional
+// blocks onto its solutions in turn, like OPTIONAL in SPARQL: a solution that
+// a block doesn't match is still returned, with the block's new variables unbound
+// (nil), and a solution that a block matches several ways is returned once for each.
+// The results are projected onto the given domain. If domain is nil, the variables
+// of the pattern are used, followed by the new variables of each block in order.
+//
+// Each block is solved as a separate query for every solution that it's joined onto,
+// so the cost grows with the number of solutions times the number of blocks.
+// All of the queries read from one transaction, so they see the same snapshot.
+func (s *Store) QueryOptional(pattern []*rdf.Quad, optional [][]*rdf.Quad, domain []rdf.Term) ([][]rdf.Term, error) {
+	if s.Config.VariablePrefix != "" {
+		pattern = bindBlankNodes(pattern, s.Config.VariablePrefix)
+		blocks := make([][]*rdf.Quad, len(optional))
+		for i, block := range optional {
+			blocks[i] = bindBlankNodes(block, s.Config.VariablePrefix)
+		}
+		optional = blocks
+	}
+
+	required := getVariables(pattern)
+	if domain == nil {
+		domain = required
+		variables := make(map[string]bool, len(required))
+		for _, node := range required {
+			variables[node.String()] = true
+		}
+		for _, block := range optional {
+			for _, node := range getVariables(block) {
+				if !variables[node.String()] {
+					variables[node.String()] = true
+					domain = append(domain, node)
+				}
+			}
+		}
+	}
+
+	txn := s.Badger.NewTransaction(false)
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { txn.Discard(); dictionary.Commit() }()
+
+	solutions, err := s.solve(pattern, required, txn, dictionary)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, block := range optional {
+		joined := []map[string]rdf.Term{}
+		for _, solution := range solutions {
+			bound, variables := substitute(block, solution)
+			if len(variables) == 0 {
+				joined = append(joined, solution)
+				continue
+			}
+
+			matches, err := s.solve(bound, variables, txn, dictionary)
+			if err != nil {
+				return nil, err
+			} else if len(matches) == 0 {
+				joined = append(joined, solution)
+				continue
+			}
+
+			for _, match := range matches {
+				for key, term := range solution {
+					match[key] = term
+				}
+				joined = append(joined, match)
+			}
+		}
+		solutions = joined
+	}
+
+	result := make([][]rdf.Term, len(solutions))
+	for i, solution := range solutions {
+		result[i] = make([]rdf.Term, len(domain))
+		for j, node := range domain {
+			result[i][j] = solution[node.String()]
+		}
+	}
+
+	return result, nil
+}
+
+// solve returns the solutions of the pattern as maps from the string
+// of each of the given variables to its value
+func (s *Store) solve(pattern []*rdf.Quad, variables []rdf.Term, txn *badger.Txn, dictionary Dictionary) ([]map[string]rdf.Term, error) {
+	iter, err := s.query(context.Background(), pattern, variables, nil, txn, dictionary, true)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	if len(variables) == 0 {
+		ok, err := iter.ask()
+		if err != nil || !ok {
+			return []map[string]rdf.Term{}, err
+		}
+		return []map[string]rdf.Term{{}}, nil
+	}
+
+	index, err := iter.project(variables)
+	if err != nil {
+		return nil, err
+	}
+
+	solutions := make([]map[string]rdf.Term, len(index))
+	for i, terms := range index {
+		solutions[i] = make(map[string]rdf.Term, len(variables))
+		for j, node := range variables {
+			solutions[i][node.String()] = terms[j]
+		}
+	}
+	return solutions, nil
+}
+
+// substitute replaces the variables of the pattern that are bound in the solution
+// with their values, and returns the new pattern and its remaining variables
+func substitute(pattern []*rdf.Quad, solution map[string]rdf.Term) ([]*rdf.Quad, []rdf.Term) {
+	bound := make([]*rdf.Quad, len(pattern))
+	for i, quad := range pattern {
+		terms := [4]rdf.Term{}
+		for j, term := range quad {
+			terms[j] = term
+			if term != nil && term.TermType() == rdf.VariableType {
+				if value, has := solution[term.String()]; has {
+					terms[j] = value
+				}
+			}
+		}
+		bound[i] = rdf.NewQuad(terms[0], terms[1], terms[2], terms[3])
+	}
+	return bound, getVariables(bound)
+}
@@ -0,0 +1,134 @@
+package styx
+
+import (
+	"container/heap"
+	"sort"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// termRank is the order of the kinds of terms that compareTerms can't compare
+func termRank(term rdf.Term) int {
+	if term == nil {
+		return 5
+	} else if _, temporal, ok := parseOrdered(term); ok && !temporal {
+		return 0
+	} else if ok {
+		return 1
+	}
+
+	switch term.TermType() {
+	case rdf.LiteralType:
+		return 2
+	case rdf.NamedNodeType:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// orderTerms is a total order on terms that agrees with compareTerms:
+// numbers, then dates, then other literals, then IRIs, then everything else.
+// Ties are broken by the terms' N-Quads serializations.
+func orderTerms(a, b rdf.Term) int {
+	if a == nil || b == nil {
+		return termRank(a) - termRank(b)
+	} else if result, ok := compareTerms(a, b); ok && result != 0 {
+		return result
+	} else if ra, rb := termRank(a), termRank(b); ra != rb {
+		return ra - rb
+	} else if x, y := a.String(), b.String(); x < y {
+		return -1
+	} else if x > y {
+		return 1
+	}
+	return 0
+}
+
+// An ordering sorts results by the term at index, keeping nil terms last
+type ordering struct {
+	results    [][]rdf.Term
+	index      int
+	descending bool
+}
+
+func (o *ordering) Len() int      { return len(o.results) }
+func (o *ordering) Swap(a, b int) { o.results[a], o.results[b] = o.results[b], o.results[a] }
+func (o *ordering) Less(a, b int) bool {
+	x, y := o.results[a][o.index], o.results[b][o.index]
+	if x == nil || y == nil || !o.descending {
+		return orderTerms(x, y) < 0
+	}
+	return orderTerms(x, y) > 0
+}
+
+// Push and Pop make a reversed ordering a heap of the best results so far,
+// with the worst of them on top
+func (o *ordering) Push(x interface{}) { o.results = append(o.results, x.([]rdf.Term)) }
+func (o *ordering) Pop() interface{} {
+	result := o.results[len(o.results)-1]
+	o.results = o.results[:len(o.results)-1]
+	return result
+}
+
+type reversed struct{ *ordering }
+
+func (r reversed) Less(a, b int) bool { return r.ordering.Less(b, a) }
+
+// OrderResults sorts results (like the ones returned by QueryOptional or QueryUnion)
+// by their terms at the given index, in the same order as CollectOrdered.
+// Unbound (nil) terms sort last in either direction.
+func OrderResults(results [][]rdf.Term, index int, descending bool) {
+	sort.Stable(&ordering{results: results, index: index, descending: descending})
+}
+
+// CollectOrdered collects the remaining results like Collect, sorted by the value
+// of the given variable: numbers and dates by value, other literals and IRIs
+// lexicographically, in ascending or descending order. Unlike Collect, it has to read
+// every solution before returning any of them. If a limit is set, only the best
+// offset + limit results are kept in memory while reading, and the offset and limit
+// are applied to the sorted results instead of to the order the solver finds them in.
+func (iter *Iterator) CollectOrdered(node rdf.Term, descending bool) ([][]rdf.Term, error) {
+	if iter.empty {
+		return nil, nil
+	}
+
+	index, has := iter.ids[node.String()]
+	if !has {
+		return nil, ErrInvalidDomain
+	}
+
+	offset, limit := iter.offset, iter.limit
+	iter.offset, iter.limit = 0, 0
+	defer func() { iter.offset, iter.limit = offset, limit }()
+
+	o := &ordering{results: [][]rdf.Term{}, index: index, descending: descending}
+	for {
+		d, err := iter.Next(nil)
+		if err != nil {
+			return nil, err
+		} else if d == nil {
+			break
+		}
+
+		result := iter.Index()
+		if limit <= 0 {
+			o.results = append(o.results, result)
+		} else if o.Len() < offset+limit {
+			heap.Push(reversed{o}, result)
+		} else if o.results = append(o.results, result); o.Less(o.Len()-1, 0) {
+			// The new result is better than the worst one kept so far
+			o.Swap(0, o.Len()-1)
+			o.results = o.results[:o.Len()-1]
+			heap.Fix(reversed{o}, 0)
+		} else {
+			o.results = o.results[:o.Len()-1]
+		}
+	}
+
+	sort.Stable(o)
+	if offset >= o.Len() {
+		return [][]rdf.Term{}, nil
+	}
+	return o.results[offset:], nil
+}
@@ -0,0 +1,90 @@
+package styx
+
+import (
+	"fmt"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// PartialSolve runs only the first depth steps of the pattern's join order
+// and returns the bindings of those variables, one map per solution,
+// keyed by variable label. Quads that only use later variables are dropped,
+// and the later variables in the remaining quads are made independent of each other,
+// so that a quad with a later variable only requires that some value for it exists.
+// Comparing len(result) for successive depths shows which join step fans out.
+// If depth is greater than the number of variables, the whole pattern is solved.
+func (s *Store) PartialSolve(pattern []*rdf.Quad, depth int) ([]map[string]rdf.Term, error) {
+	iter, err := s.Query(pattern, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := iter.Domain()
+	empty := iter.empty || iter.top
+	iter.Close()
+	if empty || depth <= 0 {
+		return []map[string]rdf.Term{}, nil
+	} else if depth < len(domain) {
+		domain = domain[:depth]
+	}
+
+	prefix := make(map[string]bool, len(domain))
+	for _, node := range domain {
+		prefix[node.String()] = true
+	}
+
+	labels := map[string]bool{}
+	for _, node := range getVariables(pattern) {
+		labels[node.Value()] = true
+	}
+
+	fresh := 0
+	partial := []*rdf.Quad{}
+	for _, quad := range pattern {
+		renamed := map[string]rdf.Term{}
+		terms := [4]rdf.Term{}
+		contained := false
+		for j, term := range quad {
+			if term == nil || term.TermType() != rdf.VariableType {
+				terms[j] = term
+			} else if prefix[term.String()] {
+				terms[j] = term
+				contained = true
+			} else if v, has := renamed[term.String()]; has {
+				terms[j] = v
+			} else {
+				label := fmt.Sprintf("v%d", fresh)
+				for ; labels[label]; label = fmt.Sprintf("v%d", fresh) {
+					fresh++
+				}
+				labels[label] = true
+				terms[j] = rdf.NewVariable(label)
+				renamed[term.String()] = terms[j]
+			}
+		}
+		if contained {
+			partial = append(partial, rdf.NewQuad(terms[0], terms[1], terms[2], terms[3]))
+		}
+	}
+
+	iter, err = s.Query(partial, domain, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	index, err := iter.project(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]map[string]rdf.Term, len(index))
+	for i, terms := range index {
+		result[i] = make(map[string]rdf.Term, len(domain))
+		for j, node := range domain {
+			result[i][node.Value()] = terms[j]
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,265 @@
+package styx
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// The key families of a store and their first bytes:
+//
+//	sequence     #  SequenceKey, the IRI dictionary's id counter
+//	schema       %  SchemaKey, the prefixes of each namespace in the database
+//	value-to-id  >  the IRI dictionary's ids
+//	id-to-value  <  the IRI dictionary's values
+//	dataset      :  the quad store's datasets (configurable with Config.Prefixes)
+//	metadata     @  application metadata attached to datasets (configurable)
+//	search       ~  the words of literals (configurable)
+//	range        ^  the values of numeric and date literals (configurable)
+//	ternary/0-2  a b c  (configurable)
+//	binary/0-5   i j k l m n  (configurable)
+//	unary        u  (configurable)
+//
+// The configurable families make up a namespace: stores with different
+// Config.Prefixes can share one database without seeing each other's datasets
+// or counts, while the others (and the registered ones) are shared by all of them.
+// Applications keep their own keys under Config.Reserved, and new index families
+// (in this package or outside of it) get their first bytes from RegisterPrefix.
+// NewStore checks that all of them are distinct, within and across namespaces.
+
+// SchemaKey starts the keys that store the prefixes of each namespace,
+// which are followed by the namespace's subject-predicate-object prefix
+var SchemaKey = []byte("%")
+
+// registry holds the key families added with RegisterPrefix
+var registry = struct {
+	sync.Mutex
+	families map[string]byte
+}{families: map[string]byte{}}
+
+// RegisterPrefix allocates the first byte of a new family of keys, like a secondary index.
+// Stores opened afterwards return ErrPrefixCollision if the byte is also used by another
+// family or reserved by Config.Reserved, and ErrPrefixMismatch if the database was
+// written with a different byte for the same family. Registering a name twice with
+// the same byte does nothing; registering it with a different byte, or registering
+// a byte that another name has, returns ErrPrefixCollision.
+func RegisterPrefix(name string, prefix byte) error {
+	registry.Lock()
+	defer registry.Unlock()
+
+	for family, b := range registry.families {
+		if family == name && b == prefix {
+			return nil
+		} else if family == name || b == prefix {
+			return ErrPrefixCollision
+		}
+	}
+
+	for _, b := range DefaultPrefixes.fixed() {
+		if b == prefix {
+			return ErrPrefixCollision
+		}
+	}
+
+	registry.families[name] = prefix
+	return nil
+}
+
+// families returns the first byte of every key family, including the registered ones
+func (p *Prefixes) families() map[string]byte {
+	families := p.fixed()
+
+	registry.Lock()
+	for name, b := range registry.families {
+		families[name] = b
+	}
+	registry.Unlock()
+
+	return families
+}
+
+// fixed returns the first bytes of the package's own key families
+func (p *Prefixes) fixed() map[string]byte {
+	families := map[string]byte{
+		"sequence":    SequenceKey[0],
+		"schema":      SchemaKey[0],
+		"value-to-id": ValueToIDPrefix,
+		"id-to-value": IDToValuePrefix,
+		"dataset":     p.Dataset,
+		"metadata":    p.Metadata,
+		"search":      p.Search,
+		"range":       p.Range,
+		"unary":       p.Unary,
+	}
+
+	for i, b := range p.Ternary {
+		families[fmt.Sprintf("ternary/%d", i)] = b
+	}
+
+	for i, b := range p.Binary {
+		families[fmt.Sprintf("binary/%d", i)] = b
+	}
+
+	return families
+}
+
+// namespaced checks whether a key family belongs to a single namespace
+func namespaced(family string) bool {
+	switch family {
+	case "dataset", "metadata", "search", "range", "unary":
+		return true
+	default:
+		return strings.HasPrefix(family, "ternary/") || strings.HasPrefix(family, "binary/")
+	}
+}
+
+// hashProbe is the value whose digest identifies a store's hash function in the schema
+var hashProbe = []byte("styx")
+
+// fingerprint identifies a hash function by its digest of hashProbe
+func fingerprint(hash HashFunction) string {
+	return hex.EncodeToString(hash(hashProbe))
+}
+
+// serializeSchema writes the key families as sorted name\tbyte lines,
+// and the fingerprint of the hash function as a "hash <fingerprint>" line
+func serializeSchema(families map[string]byte, hash string) []byte {
+	lines := make([]string, 0, len(families)+1)
+	for name, b := range families {
+		lines = append(lines, fmt.Sprintf("%s\t%d\n", name, b))
+	}
+	if hash != "" {
+		lines = append(lines, fmt.Sprintf("hash %s\n", hash))
+	}
+	sort.Strings(lines)
+	return []byte(strings.Join(lines, ""))
+}
+
+// parseSchema reads the lines that serializeSchema writes.
+// Schemas written before the hash line existed don't have a hash.
+func parseSchema(val []byte) (families map[string]byte, hash string, err error) {
+	families = map[string]byte{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(val), "\n"), "\n") {
+		if strings.HasPrefix(line, "hash ") {
+			hash = strings.TrimPrefix(line, "hash ")
+			continue
+		}
+
+		var name string
+		var b byte
+		_, err = fmt.Sscanf(line, "%s\t%d", &name, &b)
+		if err != nil {
+			return nil, "", fmt.Errorf("Invalid schema line %q: %v", line, err)
+		}
+		families[name] = b
+	}
+	return
+}
+
+// checkSchema compares the prefixes that the namespace was written with to the
+// store's and returns ErrPrefixMismatch if any family has moved. Families that are
+// new to the store (e.g. a newly registered index) are added to the schema, and
+// families that the store no longer has are left in it so that their bytes can't
+// be reused. So adding an index is safe but moving one isn't. A namespace without
+// a schema key is assumed to have been written with the store's prefixes, and gets one.
+// The schemas of the other namespaces in the database have to agree on the shared
+// families, and mustn't use any of this namespace's bytes, or checkSchema returns
+// ErrPrefixMismatch or ErrPrefixCollision. Every schema also records the fingerprint
+// of the hash function that the database's content-addressed ids were made with,
+// and a store with a different one gets ErrHashMismatch. The schema is checked in a
+// read-only transaction first and only written when it's missing or out of date,
+// and not at all if the database was opened read-only.
+func (p *Prefixes) checkSchema(db *badger.DB, hash string) error {
+	families := p.families()
+	key := append(SchemaKey[:1:1], p.Ternary[SPO])
+
+	var schema []byte
+	err := db.View(func(txn *badger.Txn) (err error) {
+		schema, err = mergeSchema(families, hash, key, txn)
+		return
+	})
+	if err != nil || schema == nil {
+		return err
+	}
+
+	// Check again in the write transaction, in case another store wrote a schema in between
+	err = db.Update(func(txn *badger.Txn) error {
+		schema, err := mergeSchema(families, hash, key, txn)
+		if err != nil || schema == nil {
+			return err
+		}
+		return txn.Set(key, schema)
+	})
+	if err == badger.ErrReadOnlyTxn {
+		return nil
+	}
+	return err
+}
+
+// mergeSchema checks the families and the hash fingerprint against the schemas in the
+// database and returns the namespace's new schema for key, or nil if the stored one
+// is already up to date
+func mergeSchema(families map[string]byte, hash string, key []byte, txn *badger.Txn) ([]byte, error) {
+	var schema map[string]byte
+	var written string
+	iter := txn.NewIterator(badger.IteratorOptions{Prefix: SchemaKey})
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		val, err := iter.Item().ValueCopy(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		other, otherHash, err := parseSchema(val)
+		if err != nil {
+			return nil, err
+		} else if otherHash != "" && otherHash != hash {
+			return nil, ErrHashMismatch
+		} else if bytes.Equal(iter.Item().Key(), key) {
+			schema, written = other, otherHash
+			continue
+		}
+
+		for name, b := range families {
+			for family, c := range other {
+				if name == family && !namespaced(name) && b != c {
+					return nil, ErrPrefixMismatch
+				} else if b == c && (name != family || namespaced(name)) {
+					return nil, ErrPrefixCollision
+				}
+			}
+		}
+	}
+
+	if schema == nil {
+		return serializeSchema(families, hash), nil
+	}
+
+	used := make(map[byte]string, len(schema))
+	for name, b := range schema {
+		used[b] = name
+	}
+
+	added := written == ""
+	for name, b := range families {
+		if previous, has := schema[name]; has && previous != b {
+			return nil, ErrPrefixMismatch
+		} else if !has && used[b] != "" {
+			// The new family's byte used to belong to another one
+			return nil, ErrPrefixMismatch
+		} else if !has {
+			schema[name] = b
+			added = true
+		}
+	}
+
+	if added {
+		return serializeSchema(schema, hash), nil
+	}
+	return nil, nil
+}
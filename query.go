@@ -12,20 +12,37 @@ import (
 func (iter *Iterator) next(i int) (tail int, err error) {
 	var ok bool
 	tail = iter.Len()
+	// Whether u is being reset to its first value that satisfies the rest of the domain
+	reset := false
 	// Okay so we start at the index given to us
 	for i >= 0 {
+		if err = iter.interrupted(); err != nil {
+			return
+		}
+
 		u := iter.variables[i]
 		// Try naively getting another value from u
 		u.value = u.Next()
-		if u.value == NIL {
+		if u.value == NIL && !reset {
 			// It didn't work :-/
-			// This means we reset u, decrement i, and continue
+			// This means we reset u to its root, and then propagate it like
+			// a new value, since the variables after u that depend on it
+			// have to be brought back to a valid state too (and the root
+			// might not have one, e.g. if a variable after it has a Range).
+			// Once that works we decrement i and continue.
+			u.value = u.Seek(u.root)
+			reset = true
+		}
+
+		if u.value == NIL {
+			// None of u's values worked, so we leave it at its root
 			u.value = u.Seek(u.root)
 			err = iter.push(u, i, iter.Len())
 			if err != nil {
 				return
 			}
 
+			reset = false
 			i--
 			continue
 		}
@@ -105,7 +122,13 @@ func (iter *Iterator) next(i int) (tail int, err error) {
 
 		// Cool - either we completed the loop over iter.out[i] naturally,
 		// or we broke out early and set cursor = j. Check for that here:
-		if cursor == i {
+		if cursor == i && reset {
+			// u is back at its first valid value, so now we move on to i-1
+			clear(iter.cache)
+			reset = false
+			i--
+			continue
+		} else if cursor == i {
 			// Success!! We brought all of the variables before and after i into
 			// a valid state. Clear the cache and return.
 			clear(iter.cache)
@@ -150,6 +173,10 @@ func (iter *Iterator) tick(i, min int, delta []*vcache) (ok bool, err error) {
 	// The biggest outer loop is walking backwards over iter.In[i]
 	x := len(iter.in[i])
 	for x > 0 {
+		if err = iter.interrupted(); err != nil {
+			return false, err
+		}
+
 		j := iter.in[i][x-1]
 
 		if j <= min {
@@ -319,18 +346,18 @@ func (iter *Iterator) push(u *variable, min, max int) (err error) {
 
 				item := c.iterator.Item()
 				meta := item.UserMeta()
-				if meta == UnaryPrefix {
+				if meta == iter.prefixes.Unary {
+					// Only the constraints of a triple without constant terms scan the unary index,
+					// and the neighbor's prefix is the binary key that starts with u's value
 					var p Permutation = i
-					if place == m {
-						p = place
-					} else if place == n {
-						p = place + 3
+					if place == n {
+						p = i + 3
 					}
-					neighbor.prefix = assembleKey(BinaryPrefixes[p], true, u.value)
+					neighbor.prefix = assembleKey(iter.prefixes.Binary[p], true, u.value)
 					neighbor.count, err = iter.unary.Get(p, u.value, iter.txn)
 				} else {
 					A, B := (neighbor.place+1)%3, (neighbor.place+2)%3
-					neighbor.prefix = assembleKey(TernaryPrefixes[A], true, neighbor.terms[A], neighbor.terms[B])
+					neighbor.prefix = assembleKey(iter.prefixes.Ternary[A], true, neighbor.terms[A], neighbor.terms[B])
 					err = item.Value(func(val []byte) error {
 						neighbor.count = binary.BigEndian.Uint32(val)
 						return nil
@@ -0,0 +1,199 @@
+package styx
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+const xsdDate = "http://www.w3.org/2001/XMLSchema#date"
+
+// parseTemporal parses an xsd:date or xsd:dateTime literal into a point in time.
+// is reports whether the term has one of those datatypes and ok whether its value
+// is well-formed, so a malformed date is one where is is true and ok is false.
+// dateTimes with a timezone are normalized to UTC, and dates and dateTimes
+// without one are read as UTC.
+func parseTemporal(term rdf.Term) (t time.Time, is bool, ok bool) {
+	literal, isLiteral := term.(*rdf.Literal)
+	if !isLiteral {
+		return
+	}
+
+	value := strings.TrimSpace(literal.Value())
+
+	var err error
+	switch literal.Datatype().Value() {
+	case xsdDateTime:
+		t, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			t, err = time.Parse("2006-01-02T15:04:05.999999999", value)
+		}
+	case xsdDate:
+		t, err = time.Parse("2006-01-02", value)
+	default:
+		return
+	}
+
+	return t.UTC(), true, err == nil
+}
+
+// parseOrdered returns the value of a numeric literal, or whether the term is
+// a well-formed xsd:date or xsd:dateTime literal. Dates don't get a value, since
+// seconds as a float64 lose nanoseconds; compareTerms orders them with parseTemporal.
+func parseOrdered(term rdf.Term) (value float64, temporal bool, ok bool) {
+	if value, ok = parseNumber(term); ok {
+		return value, false, true
+	}
+
+	_, _, ok = parseTemporal(term)
+	return 0, ok, ok
+}
+
+// malformed checks whether a term is an xsd:date or xsd:dateTime literal
+// with an invalid value, and reports it to the iterator's logger if it is
+func (iter *Iterator) malformed(term rdf.Term) bool {
+	_, is, ok := parseTemporal(term)
+	if is && !ok && iter.logger != nil {
+		iter.logger.Printf("styx: skipping malformed %s literal %q\n", term.(*rdf.Literal).Datatype().Value(), term.Value())
+	}
+	return is && !ok
+}
+
+// orderedKey encodes the value of a numeric or date literal so that the byte order
+// of the encodings is the order of the values: 'n' and the float64 bits with the sign
+// flipped (and every other bit too for negative numbers), or 't' and the big-endian
+// Unix seconds with the sign flipped and then the nanoseconds. ok is false for
+// every other term, including NaN and malformed dates, which have no place in the order.
+func orderedKey(term rdf.Term) (key []byte, ok bool) {
+	if value, is := parseNumber(term); is {
+		if math.IsNaN(value) {
+			return nil, false
+		} else if value == 0 {
+			value = 0 // -0 and 0 are equal
+		}
+
+		bits := math.Float64bits(value)
+		if bits>>63 == 1 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+
+		key = make([]byte, 9)
+		key[0] = 'n'
+		binary.BigEndian.PutUint64(key[1:], bits)
+		return key, true
+	}
+
+	t, _, ok := parseTemporal(term)
+	if !ok {
+		return nil, false
+	}
+
+	key = make([]byte, 13)
+	key[0] = 't'
+	binary.BigEndian.PutUint64(key[1:], uint64(t.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(key[9:], uint32(t.Nanosecond()))
+	return key, true
+}
+
+// indexValue writes the range key for a numeric or date literal object,
+// which is the literal's id with its orderedKey as the value.
+// Malformed dates aren't indexed, and are reported to Config.Logger.
+func (s *Store) indexValue(object rdf.Term, id ID, t *badger.Txn) (txn *badger.Txn, err error) {
+	txn = t
+	key, ok := orderedKey(object)
+	if !ok {
+		if _, is, _ := parseTemporal(object); is && s.Config.Logger != nil {
+			s.Config.Logger.Printf("styx: not indexing malformed %s literal %q\n", object.(*rdf.Literal).Datatype().Value(), object.Value())
+		}
+		return
+	}
+
+	return setSafe(assembleKey(s.Config.Prefixes.Range, false, id), key, txn, s.Badger)
+}
+
+// deleteValue removes the range key of a literal that is no longer the object of any triple
+func deleteValue(id ID, prefixes *Prefixes, t *badger.Txn, db *badger.DB) (txn *badger.Txn, err error) {
+	txn = t
+	key := assembleKey(prefixes.Range, false, id)
+	if _, err = txn.Get(key); err == badger.ErrKeyNotFound {
+		return txn, nil
+	} else if err != nil {
+		return
+	}
+	return deleteSafe(key, txn, db)
+}
+
+// Range makes Next skip solutions where the value of the given variable isn't between
+// min and max (inclusive). Either bound can be nil to leave that side open.
+// The bounds have to be numeric literals (of any numeric datatype) or xsd:date and
+// xsd:dateTime literals, and both of them have to be the same kind, otherwise Range
+// returns ErrInvalidRange. Values of the other kind (or that aren't literals at all)
+// are out of range, and so are malformed dates, which are logged to Config.Logger
+// when they're inserted.
+//
+// The range index is ordered by id like the other indices, so the variable's
+// constraint on it seeks through the index along with the others and skips the
+// literals whose values aren't in range. Literals inserted before the range index
+// existed aren't in it until Store.Refresh adds them. Range resets the iterator
+// to its first solution, like Seek(nil).
+func (iter *Iterator) Range(node rdf.Term, min, max rdf.Term) error {
+	if iter.empty {
+		return nil
+	}
+
+	index, has := iter.ids[node.String()]
+	if !has {
+		return ErrInvalidDomain
+	}
+
+	var kind byte
+	bounds := [2][]byte{}
+	for i, bound := range []rdf.Term{min, max} {
+		if bound == nil {
+			continue
+		}
+
+		key, ok := orderedKey(bound)
+		if !ok || (kind != 0 && kind != key[0]) {
+			return ErrInvalidRange
+		}
+
+		kind, bounds[i] = key[0], key
+	}
+
+	if kind == 0 {
+		return nil
+	}
+
+	// The range index doesn't count its values, so the constraint sorts
+	// after the others and filters the values that they seek to
+	prefix := []byte{iter.prefixes.Range}
+	c := &constraint{
+		index:    -1,
+		prefix:   prefix,
+		count:    math.MaxUint32,
+		iterator: iter.txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix}),
+		kind:     kind,
+		min:      bounds[0],
+		max:      bounds[1],
+	}
+
+	u := iter.variables[index]
+	u.cs = append(u.cs, c)
+	u.Sort()
+
+	if first := c.Seek(NIL); first == NIL {
+		iter.top = true
+		return nil
+	} else if u.root < first {
+		u.root = first
+	}
+
+	return iter.Seek(nil)
+}
@@ -0,0 +1,133 @@
+package styx
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// tokenize splits a string into its distinct lowercased words,
+// treating everything except letters and digits as a separator
+func tokenize(value string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(value), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := make([]string, 0, len(fields))
+	unique := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if !unique[field] {
+			unique[field] = true
+			tokens = append(tokens, field)
+		}
+	}
+	return tokens
+}
+
+// indexTokens writes the search keys for a literal object
+// if Config.SearchMinLength is set and the literal is long enough
+func (s *Store) indexTokens(object rdf.Term, id ID, t *badger.Txn) (txn *badger.Txn, err error) {
+	txn = t
+	min := s.Config.SearchMinLength
+	if min <= 0 || object.TermType() != rdf.LiteralType || len(object.Value()) < min {
+		return
+	}
+
+	for _, token := range tokenize(object.Value()) {
+		txn, err = setSafe(assembleKey(s.Config.Prefixes.Search, false, ID(token), id), nil, txn, s.Badger)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// deleteTokens removes the search keys of a literal that is no longer the object of any triple
+func deleteTokens(object rdf.Term, id ID, prefixes *Prefixes, t *badger.Txn, db *badger.DB) (txn *badger.Txn, err error) {
+	txn = t
+	for _, token := range tokenize(object.Value()) {
+		key := assembleKey(prefixes.Search, false, ID(token), id)
+		if _, err = txn.Get(key); err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return
+		}
+
+		txn, err = deleteSafe(key, txn, db)
+		if err != nil {
+			return
+		}
+	}
+	return txn, nil
+}
+
+// Search returns the literal objects that contain every word of the query,
+// ignoring case and punctuation. Only literals inserted while Config.SearchMinLength
+// was set (and at least that long) are indexed, and a literal's search keys are
+// deleted with its last quad. Search still skips literals that are no longer
+// the object of any quad, in case their keys were left behind by an older version.
+func (s *Store) Search(query string) ([]rdf.Term, error) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return []rdf.Term{}, nil
+	}
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	var ids []ID
+	for i, token := range tokens {
+		prefix := assembleKey(s.Config.Prefixes.Search, true, ID(token))
+		matches := map[ID]bool{}
+		iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+		for iter.Seek(prefix); iter.Valid(); iter.Next() {
+			matches[ID(iter.Item().Key()[len(prefix):])] = true
+		}
+		iter.Close()
+
+		if i == 0 {
+			for id := range matches {
+				ids = append(ids, id)
+			}
+			sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		} else {
+			intersection := ids[:0]
+			for _, id := range ids {
+				if matches[id] {
+					intersection = append(intersection, id)
+				}
+			}
+			ids = intersection
+		}
+	}
+
+	result := []rdf.Term{}
+	for _, id := range ids {
+		if !hasObject(id, s.Config.Prefixes, txn) {
+			continue
+		}
+
+		term, err := dictionary.GetTerm(id, rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, term)
+	}
+
+	return result, nil
+}
+
+// hasObject checks whether any triple has the given object
+func hasObject(id ID, prefixes *Prefixes, txn *badger.Txn) bool {
+	prefix := assembleKey(prefixes.Ternary[OSP], true, id)
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer iter.Close()
+	iter.Seek(prefix)
+	return iter.ValidForPrefix(prefix)
+}
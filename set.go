@@ -1,7 +1,9 @@
 package styx
 
 import (
+	"io"
 	"strings"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 	ld "github.com/piprate/json-gold/ld"
@@ -10,7 +12,98 @@ import (
 
 // SetJSONLD sets a JSON-LD document
 func (s *Store) SetJSONLD(uri string, input interface{}, canonize bool) error {
-	var node rdf.Term = rdf.Default
+	node, quads, err := normalizeJSONLD(uri, input, canonize)
+	if err != nil {
+		return err
+	}
+	return s.Set(node, fromLdQuads(quads))
+}
+
+// SetJSONLDMany normalizes several JSON-LD documents like SetJSONLD
+// and inserts them together with SetMany
+func (s *Store) SetJSONLDMany(uris []string, inputs []interface{}, canonize bool) error {
+	if len(uris) != len(inputs) {
+		return ErrInvalidInput
+	}
+
+	nodes := make([]rdf.Term, len(uris))
+	datasets := make([][]*rdf.Quad, len(uris))
+	for i, uri := range uris {
+		node, quads, err := normalizeJSONLD(uri, inputs[i], canonize)
+		if err != nil {
+			return err
+		}
+		nodes[i], datasets[i] = node, fromLdQuads(quads)
+	}
+
+	return s.SetMany(nodes, datasets)
+}
+
+// SetRDFDataset sets a dataset that's already been parsed into a json-gold RDFDataset
+// (e.g. from N-Quads or Turtle), skipping the JSON-LD expansion and normalization
+// that SetJSONLD does. The dataset's blank node labels are kept as they are.
+func (s *Store) SetRDFDataset(node rdf.Term, dataset *ld.RDFDataset) error {
+	if dataset == nil {
+		return ErrInvalidInput
+	}
+	return s.Set(node, fromLdQuads(fromLdDatasetQuads(dataset)))
+}
+
+// SetNQuads parses an N-Quads document and sets it like SetRDFDataset,
+// so its blank node labels are kept as they are. It reads the same
+// serialization that Dump writes. (There's no Turtle parser in json-gold,
+// so Turtle has to be parsed into an RDFDataset by the caller.)
+func (s *Store) SetNQuads(node rdf.Term, r io.Reader) error {
+	dataset, err := ld.ParseNQuadsFrom(r)
+	if err != nil {
+		return err
+	}
+	return s.SetRDFDataset(node, dataset)
+}
+
+// SetJSONLDExpect is like SetJSONLD, except that it first compares the normalized
+// document with the expected N-Quads serialization and returns ErrUnexpectedDataset
+// without writing anything if they differ. The comparison ignores the order of the lines,
+// so the expected serialization only needs to have the same quads (with the same blank
+// node labels) as the one json-gold produces for the document.
+// This catches remote contexts that have changed since the expectation was written.
+func (s *Store) SetJSONLDExpect(uri string, input interface{}, canonize bool, expected string) error {
+	node, quads, err := normalizeJSONLD(uri, input, canonize)
+	if err != nil {
+		return err
+	}
+
+	dataset, err := ld.ParseNQuads(expected)
+	if err != nil {
+		return err
+	}
+
+	actual, err := serializeLdQuads(quads)
+	if err != nil {
+		return err
+	}
+
+	target, err := serializeLdQuads(fromLdDatasetQuads(dataset))
+	if err != nil {
+		return err
+	}
+
+	if len(actual) != len(target) {
+		return ErrUnexpectedDataset
+	}
+
+	for i, line := range actual {
+		if line != target[i] {
+			return ErrUnexpectedDataset
+		}
+	}
+
+	return s.Set(node, fromLdQuads(quads))
+}
+
+// normalizeJSONLD converts a JSON-LD document to the quads that SetJSONLD inserts
+func normalizeJSONLD(uri string, input interface{}, canonize bool) (node rdf.Term, quads []*ld.Quad, err error) {
+	node = rdf.Default
 	if uri != "" {
 		node = rdf.NewNamedNode(uri)
 	}
@@ -18,117 +111,146 @@ func (s *Store) SetJSONLD(uri string, input interface{}, canonize bool) error {
 	opts := ld.NewJsonLdOptions(uri)
 	dataset, err := getDataset(input, opts)
 	if err != nil {
-		return err
+		return
 	}
 
 	if canonize {
 		na := ld.NewNormalisationAlgorithm(Algorithm)
 		na.Normalize(dataset)
+		quads = na.Quads()
+	} else {
+		quads = fromLdDatasetQuads(dataset)
+	}
 
-		quads := []*rdf.Quad{}
-		for _, quad := range na.Quads() {
-			quads = append(quads, fromLdQuad(quad, ""))
-		}
+	return
+}
+
+// SetGraph inserts the dataset like Set, except that every quad is placed
+// in the given named graph instead of the graph it was parsed into.
+// The graph is what Prov reports as the source of the dataset's statements,
+// so this lets callers record an external name (like a dataset id)
+// rather than the document's own default or blank graphs.
+func (s *Store) SetGraph(node rdf.Term, graph rdf.Term, dataset []*rdf.Quad) error {
+	if graph.TermType() != rdf.NamedNodeType {
+		return ErrInvalidInput
+	}
 
-		return s.Set(node, quads)
+	quads := make([]*rdf.Quad, len(dataset))
+	for i, quad := range dataset {
+		quads[i] = rdf.NewQuad(quad[0], quad[1], quad[2], graph)
 	}
-	return s.Set(node, fromLdDataset(dataset, ""))
+
+	return s.Set(node, quads)
 }
 
-// Set is the entrypoint to inserting stuff
-func (s *Store) Set(node rdf.Term, dataset []*rdf.Quad) (err error) {
-	if node.TermType() == rdf.NamedNodeType {
-		uri := node.Value()
-		if strings.Index(uri, "#") != -1 || !s.Config.TagScheme.Test(uri+"#") {
-			return ErrTagScheme
+// Set is the entrypoint to inserting stuff.
+// If a dataset already exists at the given node, Set swaps its contents for
+// the new dataset in the same transaction: triples that occur in both keep
+// their index and count keys and only have their statements rewritten,
+// so the dataset is never transiently empty and unchanged triples aren't re-counted.
+func (s *Store) Set(node rdf.Term, dataset []*rdf.Quad) error {
+	return s.SetMany([]rdf.Term{node}, [][]*rdf.Quad{dataset})
+}
+
+// SetMany sets several datasets at once, like calling Set for each of them,
+// except that they're all written in one transaction (which is only split
+// when it outgrows Badger's limits) and the count keys are read and written once
+// for the whole batch, no matter how many of the datasets touch them.
+// Each node can only appear once. Writes (SetMany, Add, Delete, Retract, Refresh,
+// and Restore) are safe to call from several goroutines; they run one at a time.
+func (s *Store) SetMany(nodes []rdf.Term, datasets [][]*rdf.Quad) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.setMany(nodes, datasets)
+}
+
+// setMany is SetMany for callers that already hold s.lock
+func (s *Store) setMany(nodes []rdf.Term, datasets [][]*rdf.Quad) (err error) {
+	if len(nodes) != len(datasets) {
+		return ErrInvalidInput
+	}
+
+	started := time.Now()
+
+	for _, node := range nodes {
+		err = s.checkNode(node)
+		if err != nil {
+			return
 		}
 	}
 
+	if s.Config.NormalizeDateTimes {
+		// Normalize into a new slice so that the caller's datasets stay as they were
+		normalized := make([][]*rdf.Quad, len(datasets))
+		for i, dataset := range datasets {
+			normalized[i] = normalizeDateTimes(dataset)
+		}
+		datasets = normalized
+	}
+
 	dictionary := s.Config.Dictionary.Open(true)
 	txn := s.Badger.NewTransaction(true)
 	defer func() { txn.Discard(); dictionary.Commit() }()
 
-	uc := newUnaryCache()
-	bc := newBinaryCache()
+	uc := newUnaryCache(s.Config.Prefixes.Unary)
+	bc := newBinaryCache(s.Config.Prefixes.Binary)
 
-	origin, err := dictionary.GetID(node, rdf.Default)
+	opaque, err := s.opaqueIDs(dictionary)
 	if err != nil {
 		return
 	}
 
-	quads, err := s.Config.QuadStore.Get(origin)
-	if err != nil && err != ErrNotFound {
-		return
-	} else if quads != nil {
-		txn, err = deleteQuads(origin, quads, dictionary, txn, s.Badger)
+	origins := make([]ID, len(nodes))
+	batch := make([][][4]ID, len(nodes))
+	retain := map[string]bool{}
+	unique := make(map[ID]bool, len(nodes))
+	for i, node := range nodes {
+		origins[i], err = dictionary.GetID(node, rdf.Default)
 		if err != nil {
 			return
+		} else if unique[origins[i]] {
+			return ErrInvalidInput
 		}
-	}
-
-	quads = make([][4]ID, len(dataset))
+		unique[origins[i]] = true
 
-	var terms [3]ID
-	var id ID
-	var item *badger.Item
-	var val []byte
-	for i, quad := range dataset {
-		source := &Statement{
-			base:  iri(origin),
-			index: uint64(i),
+		batch[i] = make([][4]ID, len(datasets[i]))
+		for j, quad := range datasets[i] {
+			for k := 0; k < 4; k++ {
+				batch[i][j][k], err = dictionary.GetID(quad[k], node)
+				if err != nil {
+					return
+				}
+			}
+			retain[string(assembleKey(s.Config.Prefixes.Ternary[0], false, batch[i][j][:3]...))] = true
 		}
+	}
 
-		for j := Permutation(0); j < 4; j++ {
-			id, err = dictionary.GetID(quad[j], node)
+	// Remove the previous versions of the datasets before inserting any of the new ones,
+	// since deleteQuads commits its own counts to the transaction.
+	for _, origin := range origins {
+		var previous [][4]ID
+		previous, err = s.Config.QuadStore.Get(origin)
+		if err != nil && err != ErrNotFound {
+			return
+		} else if previous != nil {
+			txn, err = deleteQuads(origin, previous, retain, s.Config.Prefixes, opaque, dictionary, txn, s.Badger)
 			if err != nil {
 				return
 			}
-
-			quads[i][j] = id
-
-			if j < 3 {
-				terms[j] = id
-				// } else if t := quad[j].TermType(); t == rdf.BlankNodeType || t == rdf.DefaultGraphType {
-				// 	source.Graph, err = dictionary.GetID(quad[j], rdf.Default)
-				// 	if err != nil {
-				// 		return
-				// 	}
-			} else {
-				source.graph = id
-			}
 		}
+	}
 
-		for p := Permutation(0); p < 3; p++ {
-			a, b, c := major.permute(p, terms)
-			key := assembleKey(TernaryPrefixes[p], false, a, b, c)
-			item, err = txn.Get(key)
-			if err == badger.ErrKeyNotFound {
-				// Since this is a new key we have to increment two binary keys.
-				ab, ba := p, ((p+1)%3)+3
-				err = bc.Increment(ab, a, b, uc, txn)
-				if err != nil {
-					return
-				}
-				err = bc.Increment(ba, b, a, uc, txn)
-				if err != nil {
-					return
-				}
-				if p == 0 {
-					val = []byte(source.String())
-				}
-				txn, err = setSafe(key, val, txn, s.Badger)
-				if err != nil {
-					return
-				}
-			} else if err != nil {
+	for i, quads := range batch {
+		for j, quad := range quads {
+			txn, err = insertQuad(origins[i], j, quad, s.Config.Prefixes, opaque, uc, bc, txn, s.Badger)
+			if err != nil {
 				return
-			} else if p == 0 {
-				val, err = item.ValueCopy(nil)
+			} else if !opaque[quad[1]] {
+				txn, err = s.indexTokens(datasets[i][j][2], quad[2], txn)
 				if err != nil {
 					return
 				}
-				val = append(val, source.String()...)
-				txn, err = setSafe(key, val, txn, s.Badger)
+				txn, err = s.indexValue(datasets[i][j][2], quad[2], txn)
 				if err != nil {
 					return
 				}
@@ -151,5 +273,213 @@ func (s *Store) Set(node rdf.Term, dataset []*rdf.Quad) (err error) {
 		return
 	}
 
-	return s.Config.QuadStore.Set(origin, quads)
+	quads := 0
+	for i, origin := range origins {
+		err = s.Config.QuadStore.Set(origin, batch[i])
+		if err != nil {
+			return
+		}
+		quads += len(batch[i])
+	}
+
+	// The datasets are written before verifying so that an inconsistent count
+	// doesn't also leave the committed index keys without their datasets
+	if s.Config.Verify {
+		err = s.Badger.View(func(txn *badger.Txn) error {
+			if err := bc.Verify(txn); err != nil {
+				return err
+			}
+			return uc.Verify(txn)
+		})
+		if err != nil {
+			return
+		}
+	}
+
+	if s.Config.Metrics != nil {
+		s.Config.Metrics.ObserveSet(quads, time.Since(started))
+	}
+
+	return
+}
+
+// Add inserts a single quad into the dataset at the given node, exactly as if
+// it had been appended to the dataset that was last passed to Set.
+// If there is no dataset at the node yet, Add creates one.
+func (s *Store) Add(node rdf.Term, quad *rdf.Quad) (err error) {
+	err = s.checkNode(node)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	started := time.Now()
+	dictionary := s.Config.Dictionary.Open(true)
+	txn := s.Badger.NewTransaction(true)
+	defer func() { txn.Discard(); dictionary.Commit() }()
+
+	uc := newUnaryCache(s.Config.Prefixes.Unary)
+	bc := newBinaryCache(s.Config.Prefixes.Binary)
+
+	origin, err := dictionary.GetID(node, rdf.Default)
+	if err != nil {
+		return
+	}
+
+	if s.Config.NormalizeDateTimes {
+		quad = normalizeDateTimes([]*rdf.Quad{quad})[0]
+	}
+
+	var ids [4]ID
+	for j := 0; j < 4; j++ {
+		ids[j], err = dictionary.GetID(quad[j], node)
+		if err != nil {
+			return
+		}
+	}
+
+	quads, err := s.Config.QuadStore.Get(origin)
+	if err == ErrNotFound {
+		err = nil
+	} else if err != nil {
+		return
+	}
+
+	opaque, err := s.opaqueIDs(dictionary)
+	if err != nil {
+		return
+	}
+
+	txn, err = insertQuad(origin, len(quads), ids, s.Config.Prefixes, opaque, uc, bc, txn, s.Badger)
+	if err != nil {
+		return
+	} else if !opaque[ids[1]] {
+		txn, err = s.indexTokens(quad[2], ids[2], txn)
+		if err != nil {
+			return
+		}
+		txn, err = s.indexValue(quad[2], ids[2], txn)
+		if err != nil {
+			return
+		}
+	}
+
+	txn, err = bc.Commit(s.Badger, txn)
+	if err != nil {
+		return
+	}
+
+	txn, err = uc.Commit(s.Badger, txn)
+	if err != nil {
+		return
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		return
+	}
+
+	err = s.Config.QuadStore.Set(origin, append(quads, ids))
+	if err == nil && s.Config.Metrics != nil {
+		s.Config.Metrics.ObserveSet(1, time.Since(started))
+	}
+	return
+}
+
+// checkNode checks that a dataset's node is either the default graph
+// or an IRI without a fragment that validates the tag scheme
+func (s *Store) checkNode(node rdf.Term) error {
+	if node.TermType() == rdf.NamedNodeType {
+		uri := node.Value()
+		if strings.Index(uri, "#") != -1 || !s.Config.TagScheme.Test(uri+"#") {
+			return ErrTagScheme
+		}
+	}
+	return nil
+}
+
+// insertQuad writes the index keys for the ith quad of the dataset at origin,
+// incrementing the counts of any new triples in the caches
+func insertQuad(origin ID, i int, quad [4]ID, prefixes *Prefixes, opaque map[ID]bool, uc unaryCache, bc binaryCache, t *badger.Txn, db *badger.DB) (txn *badger.Txn, err error) {
+	txn = t
+	source := &Statement{
+		base:  iri(origin),
+		index: uint64(i),
+		graph: quad[3],
+	}
+
+	var item *badger.Item
+	var val []byte
+	terms := [3]ID{quad[0], quad[1], quad[2]}
+	for p := Permutation(0); p < 3; p++ {
+		// Opaque quads only get the subject-predicate-object key,
+		// and so only the subject-predicate and predicate-subject counts.
+		if p > 0 && opaque[quad[1]] {
+			break
+		}
+
+		a, b, c := major.permute(p, terms)
+		key := assembleKey(prefixes.Ternary[p], false, a, b, c)
+		item, err = txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			// Since this is a new key we have to increment two binary keys.
+			ab, ba := p, ((p+1)%3)+3
+			err = bc.Increment(ab, a, b, uc, txn)
+			if err != nil {
+				return
+			}
+			err = bc.Increment(ba, b, a, uc, txn)
+			if err != nil {
+				return
+			}
+			if p == 0 {
+				val = []byte(source.String())
+			}
+			txn, err = setSafe(key, val, txn, db)
+			if err != nil {
+				return
+			}
+		} else if err != nil {
+			return
+		} else if p == 0 {
+			val, err = item.ValueCopy(nil)
+			if err != nil {
+				return
+			}
+			val = append(val, source.String()...)
+			txn, err = setSafe(key, val, txn, db)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// isOpaque checks whether a term is one of the configured opaque predicates
+func (s *Store) isOpaque(term rdf.Term) bool {
+	for _, predicate := range s.Config.OpaquePredicates {
+		if predicate.Equal(term) {
+			return true
+		}
+	}
+	return false
+}
+
+// opaqueIDs returns the ids of the configured opaque predicates.
+// Predicates that aren't in a read-only dictionary are skipped.
+func (s *Store) opaqueIDs(dictionary Dictionary) (map[ID]bool, error) {
+	opaque := make(map[ID]bool, len(s.Config.OpaquePredicates))
+	for _, predicate := range s.Config.OpaquePredicates {
+		id, err := dictionary.GetID(predicate, rdf.Default)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		opaque[id] = true
+	}
+	return opaque, nil
 }
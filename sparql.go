@@ -0,0 +1,391 @@
+package styx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	ld "github.com/piprate/json-gold/ld"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// A QueryPlan is a parsed SPARQL SELECT query
+type QueryPlan struct {
+	Domain  []rdf.Term  // The projected variables, or nil for SELECT *
+	Pattern []*rdf.Quad // The basic graph pattern of the WHERE clause
+	Limit   int         // Zero means no limit
+	Offset  int
+}
+
+// ParseSPARQL parses a subset of SPARQL SELECT queries:
+//
+//	PREFIX ex: <http://example.com/>
+//	SELECT ?name WHERE { ?person a ex:Person ; ex:name ?name . } LIMIT 10 OFFSET 20
+//
+// The WHERE clause is a basic graph pattern of triples in the default graph,
+// with ; and , to repeat the subject and predicate. Terms are IRIs, prefixed names,
+// the keyword a, variables (?x or $x), blank nodes (which are existential variables),
+// and string, integer, decimal, and boolean literals. FILTER, OPTIONAL, UNION,
+// GRAPH, and solution modifiers other than LIMIT and OFFSET aren't supported.
+func ParseSPARQL(query string) (*QueryPlan, error) {
+	p := &sparqlParser{scanner: sparqlScanner{input: query}, prefixes: map[string]string{}}
+	return p.parse()
+}
+
+// QuerySPARQL parses the query with ParseSPARQL and opens an iterator
+// over its pattern with its projection, limit, and offset
+func (s *Store) QuerySPARQL(query string) (*Iterator, error) {
+	plan, err := ParseSPARQL(query)
+	if err != nil {
+		return nil, err
+	}
+
+	iter, err := s.Query(plan.Pattern, plan.Domain, nil)
+	if err != nil {
+		return iter, err
+	}
+
+	iter.Limit(plan.Limit)
+	iter.Offset(plan.Offset)
+	return iter, nil
+}
+
+// sparqlScanner splits a query into tokens: IRIs, string literals,
+// punctuation, and words (keywords, variables, prefixed names, and numbers)
+type sparqlScanner struct {
+	input string
+	pos   int
+	peek  *string
+}
+
+func (s *sparqlScanner) skip() {
+	for s.pos < len(s.input) {
+		if c := s.input[s.pos]; c == '#' {
+			for s.pos < len(s.input) && s.input[s.pos] != '\n' {
+				s.pos++
+			}
+		} else if unicode.IsSpace(rune(c)) {
+			s.pos++
+		} else {
+			return
+		}
+	}
+}
+
+// Next returns the next token, or "" at the end of the input
+func (s *sparqlScanner) Next() (string, error) {
+	if s.peek != nil {
+		token := *s.peek
+		s.peek = nil
+		return token, nil
+	}
+
+	s.skip()
+	if s.pos == len(s.input) {
+		return "", nil
+	}
+
+	start := s.pos
+	switch c := s.input[s.pos]; c {
+	case '{', '}', '.', ';', ',', '*':
+		s.pos++
+	case '<':
+		end := strings.IndexByte(s.input[s.pos:], '>')
+		if end == -1 {
+			return "", fmt.Errorf("Unterminated IRI at offset %d", start)
+		}
+		s.pos += end + 1
+	case '"':
+		for s.pos++; s.pos < len(s.input) && s.input[s.pos] != '"'; s.pos++ {
+			if s.input[s.pos] == '\\' {
+				s.pos++
+			}
+		}
+		if s.pos >= len(s.input) {
+			return "", fmt.Errorf("Unterminated string at offset %d", start)
+		}
+		s.pos++
+	case '^':
+		if !strings.HasPrefix(s.input[s.pos:], "^^") {
+			return "", fmt.Errorf("Unexpected ^ at offset %d", start)
+		}
+		s.pos += 2
+	default:
+		for s.pos < len(s.input) {
+			c := s.input[s.pos]
+			if unicode.IsSpace(rune(c)) || strings.IndexByte("{}<\";,#^", c) != -1 {
+				break
+			} else if c == '.' && (s.pos+1 == len(s.input) || !isNameByte(s.input[s.pos+1])) {
+				// A dot ends a word unless a name or number continues after it
+				break
+			}
+			s.pos++
+		}
+	}
+
+	return s.input[start:s.pos], nil
+}
+
+// Peek returns the next token without consuming it
+func (s *sparqlScanner) Peek() (string, error) {
+	if s.peek == nil {
+		token, err := s.Next()
+		if err != nil {
+			return "", err
+		}
+		s.peek = &token
+	}
+	return *s.peek, nil
+}
+
+func isNameByte(c byte) bool {
+	return c == '_' || c == '-' || c == ':' || c >= '0' && c <= '9' || unicode.IsLetter(rune(c))
+}
+
+type sparqlParser struct {
+	scanner  sparqlScanner
+	prefixes map[string]string
+}
+
+func (p *sparqlParser) expect(expected string) error {
+	token, err := p.scanner.Next()
+	if err != nil {
+		return err
+	} else if !strings.EqualFold(token, expected) {
+		return fmt.Errorf("Expected %s but got %q", expected, token)
+	}
+	return nil
+}
+
+func (p *sparqlParser) parse() (*QueryPlan, error) {
+	plan := &QueryPlan{}
+
+	// Prologue
+	for {
+		token, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if strings.EqualFold(token, "SELECT") {
+			break
+		} else if !strings.EqualFold(token, "PREFIX") {
+			return nil, fmt.Errorf("Expected PREFIX or SELECT but got %q", token)
+		}
+
+		name, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if !strings.HasSuffix(name, ":") {
+			return nil, fmt.Errorf("Invalid prefix name %q", name)
+		}
+
+		iri, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if !strings.HasPrefix(iri, "<") {
+			return nil, fmt.Errorf("Expected an IRI for prefix %s but got %q", name, iri)
+		}
+		p.prefixes[strings.TrimSuffix(name, ":")] = iri[1 : len(iri)-1]
+	}
+
+	// Projection
+	for {
+		token, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if token == "*" && plan.Domain == nil {
+			if next, err := p.scanner.Peek(); err != nil {
+				return nil, err
+			} else if next != "{" && !strings.EqualFold(next, "WHERE") {
+				return nil, fmt.Errorf("Unexpected %q after SELECT *", next)
+			}
+		} else if isSPARQLVariable(token) {
+			plan.Domain = append(plan.Domain, rdf.NewVariable(token[1:]))
+			continue
+		} else if plan.Domain == nil {
+			return nil, fmt.Errorf("Expected variables or * after SELECT but got %q", token)
+		} else {
+			p.scanner.peek = &token
+		}
+		break
+	}
+
+	if token, err := p.scanner.Peek(); err != nil {
+		return nil, err
+	} else if strings.EqualFold(token, "WHERE") {
+		p.scanner.Next()
+	}
+
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	pattern, err := p.parseTriples()
+	if err != nil {
+		return nil, err
+	}
+	plan.Pattern = pattern
+
+	// Solution modifiers
+	for {
+		token, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if token == "" {
+			return plan, nil
+		}
+
+		var value *int
+		if strings.EqualFold(token, "LIMIT") {
+			value = &plan.Limit
+		} else if strings.EqualFold(token, "OFFSET") {
+			value = &plan.Offset
+		} else {
+			return nil, fmt.Errorf("Unexpected %q after the WHERE clause", token)
+		}
+
+		number, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if *value, err = strconv.Atoi(number); err != nil || *value < 0 {
+			return nil, fmt.Errorf("Invalid %s %q", strings.ToUpper(token), number)
+		}
+	}
+}
+
+// parseTriples parses the triples of a group up to and including its closing brace
+func (p *sparqlParser) parseTriples() ([]*rdf.Quad, error) {
+	pattern := []*rdf.Quad{}
+	for {
+		token, err := p.scanner.Next()
+		if err != nil {
+			return nil, err
+		} else if token == "}" {
+			return pattern, nil
+		} else if token == "." && len(pattern) > 0 {
+			continue
+		}
+
+		subject, err := p.parseTerm(token)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			token, err := p.scanner.Next()
+			if err != nil {
+				return nil, err
+			}
+
+			var predicate rdf.Term
+			if token == "a" {
+				predicate = rdf.NewNamedNode(ld.RDFType)
+			} else if predicate, err = p.parseTerm(token); err != nil {
+				return nil, err
+			} else if t := predicate.TermType(); t != rdf.NamedNodeType && t != rdf.VariableType {
+				return nil, fmt.Errorf("Invalid predicate %q", token)
+			}
+
+			for {
+				token, err := p.scanner.Next()
+				if err != nil {
+					return nil, err
+				}
+
+				object, err := p.parseTerm(token)
+				if err != nil {
+					return nil, err
+				}
+
+				pattern = append(pattern, rdf.NewQuad(subject, predicate, object, rdf.Default))
+				if next, err := p.scanner.Peek(); err != nil {
+					return nil, err
+				} else if next != "," {
+					break
+				}
+				p.scanner.Next()
+			}
+
+			if next, err := p.scanner.Peek(); err != nil {
+				return nil, err
+			} else if next != ";" {
+				break
+			}
+			p.scanner.Next()
+		}
+
+		if next, err := p.scanner.Peek(); err != nil {
+			return nil, err
+		} else if next != "." && next != "}" {
+			return nil, fmt.Errorf("Expected . or } but got %q", next)
+		}
+	}
+}
+
+func isSPARQLVariable(token string) bool {
+	return len(token) > 1 && (token[0] == '?' || token[0] == '$')
+}
+
+func (p *sparqlParser) parseTerm(token string) (rdf.Term, error) {
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("Unexpected end of query")
+	case isSPARQLVariable(token):
+		return rdf.NewVariable(token[1:]), nil
+	case strings.HasPrefix(token, "<"):
+		return rdf.NewNamedNode(token[1 : len(token)-1]), nil
+	case strings.HasPrefix(token, "_:"):
+		return rdf.NewBlankNode(token[2:]), nil
+	case strings.HasPrefix(token, "\""):
+		value, err := strconv.Unquote(token)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid string %s", token)
+		}
+		return p.parseLiteral(value)
+	case token == "true" || token == "false":
+		return rdf.NewLiteral(token, "", rdf.NewNamedNode(ld.XSDBoolean)), nil
+	case strings.IndexByte("+-0123456789", token[0]) != -1:
+		if _, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return rdf.NewLiteral(token, "", rdf.NewNamedNode(ld.XSDInteger)), nil
+		} else if _, err := strconv.ParseFloat(token, 64); err == nil && strings.Contains(token, ".") {
+			return rdf.NewLiteral(token, "", rdf.NewNamedNode(ld.XSDDecimal)), nil
+		}
+		return nil, fmt.Errorf("Invalid number %q", token)
+	case strings.Contains(token, ":"):
+		i := strings.IndexByte(token, ':')
+		base, has := p.prefixes[token[:i]]
+		if !has {
+			return nil, fmt.Errorf("Undefined prefix in %q", token)
+		}
+		return rdf.NewNamedNode(base + token[i+1:]), nil
+	default:
+		return nil, fmt.Errorf("Unexpected %q", token)
+	}
+}
+
+// parseLiteral reads the language tag or datatype that follows a string, if any
+func (p *sparqlParser) parseLiteral(value string) (rdf.Term, error) {
+	next, err := p.scanner.Peek()
+	if err != nil {
+		return nil, err
+	} else if strings.HasPrefix(next, "@") && len(next) > 1 {
+		p.scanner.Next()
+		return rdf.NewLiteral(value, next[1:], rdf.RDFLangString), nil
+	} else if next != "^^" {
+		return rdf.NewLiteral(value, "", nil), nil
+	}
+
+	p.scanner.Next()
+	token, err := p.scanner.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	datatype, err := p.parseTerm(token)
+	if err != nil {
+		return nil, err
+	} else if datatype.TermType() != rdf.NamedNodeType {
+		return nil, fmt.Errorf("Invalid datatype %q", token)
+	}
+	return rdf.NewLiteral(value, "", datatype.(*rdf.NamedNode)), nil
+}
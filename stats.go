@@ -0,0 +1,119 @@
+package styx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	badger "github.com/dgraph-io/badger/v2"
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// StoreStats are totals read from a store's count keys
+type StoreStats struct {
+	Triples    uint64 // The number of distinct triples (a triple asserted by several datasets counts once)
+	Subjects   int    // The number of distinct subjects
+	Predicates int    // The number of distinct predicates
+	Objects    int    // The number of distinct objects, except the objects of opaque predicates
+	Top        []PredicateCount
+}
+
+// PredicateCount is the number of distinct triples that have a predicate
+type PredicateCount struct {
+	Predicate rdf.Term
+	Triples   uint64
+}
+
+// Stats aggregates the count keys into the number of triples and distinct terms,
+// and the top most frequent predicates (all of them if top is negative).
+// It reads every unary count key (one per distinct term) and every
+// predicate-subject binary count key (one per distinct pair), so it costs
+// a scan of those two prefixes rather than of the ternary index.
+// The objects of opaque predicates aren't indexed by object, so they aren't counted.
+func (s *Store) Stats(top int) (*StoreStats, error) {
+	prefixes := s.Config.Prefixes
+	stats := &StoreStats{}
+
+	txn := s.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	iter := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{prefixes.Unary}})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		err := iter.Item().Value(func(val []byte) error {
+			if len(val) != 24 {
+				return ErrInconsistentCount
+			}
+			if binary.BigEndian.Uint32(val[SPO*4:]) > 0 {
+				stats.Subjects++
+			}
+			if binary.BigEndian.Uint32(val[PSO*4:]) > 0 {
+				stats.Predicates++
+			}
+			if binary.BigEndian.Uint32(val[OSP*4:]) > 0 {
+				stats.Objects++
+			}
+			return nil
+		})
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	iter.Close()
+
+	// Each predicate-subject key counts the objects of the pair
+	predicates := map[ID]uint64{}
+	iter = txn.NewIterator(badger.IteratorOptions{Prefix: []byte{prefixes.Binary[PSO]}})
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		key := iter.Item().Key()
+		i := bytes.IndexByte(key, '\t')
+		if i == -1 {
+			continue
+		}
+
+		p := ID(key[1:i])
+		err := iter.Item().Value(func(val []byte) error {
+			if len(val) != 4 {
+				return ErrInconsistentCount
+			}
+			predicates[p] += uint64(binary.BigEndian.Uint32(val))
+			return nil
+		})
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+	}
+	iter.Close()
+
+	ids := make([]ID, 0, len(predicates))
+	for p, count := range predicates {
+		stats.Triples += count
+		ids = append(ids, p)
+	}
+
+	sort.Slice(ids, func(a, b int) bool {
+		if predicates[ids[a]] != predicates[ids[b]] {
+			return predicates[ids[a]] > predicates[ids[b]]
+		}
+		return ids[a] < ids[b]
+	})
+
+	if top >= 0 && top < len(ids) {
+		ids = ids[:top]
+	}
+
+	dictionary := s.Config.Dictionary.Open(false)
+	defer func() { dictionary.Commit() }()
+
+	stats.Top = make([]PredicateCount, len(ids))
+	for i, p := range ids {
+		predicate, err := dictionary.GetTerm(p, rdf.Default)
+		if err != nil {
+			return nil, err
+		}
+		stats.Top[i] = PredicateCount{Predicate: predicate, Triples: predicates[p]}
+	}
+
+	return stats, nil
+}
@@ -106,16 +106,22 @@ func (m *memoryStore) List(id ID) interface {
 	return &memoryList{i, m}
 }
 
-type badgerStore struct{ Badger *badger.DB }
+type badgerStore struct {
+	Badger *badger.DB
+	prefix byte
+}
 
-// MakeBadgerStore creates new badger quad store
-func MakeBadgerStore(db *badger.DB) QuadStore { return &badgerStore{Badger: db} }
+// MakeBadgerStore creates new badger quad store.
+// NewStore gives each store a copy that keeps its keys under the store's Config.Prefixes.Dataset.
+func MakeBadgerStore(db *badger.DB) QuadStore {
+	return &badgerStore{Badger: db, prefix: DatasetPrefix}
+}
 
 func (b *badgerStore) Get(id ID) ([][4]ID, error) {
 	txn := b.Badger.NewTransaction(false)
 	defer func() { txn.Discard() }()
 
-	key := assembleKey(DatasetPrefix, false, id)
+	key := assembleKey(b.prefix, false, id)
 	item, err := txn.Get(key)
 	if err == badger.ErrKeyNotFound {
 		return nil, ErrNotFound
@@ -131,11 +137,13 @@ var ErrParseQuads = errors.New("Error parsing quads from Badger datastore")
 
 func getQuads(item *badger.Item) (quads [][4]ID, err error) {
 	err = item.Value(func(val []byte) error {
-		lines := strings.Split(string(val), "\n")
-		if len(lines) < 2 {
-			return ErrParseQuads
+		if len(val) == 0 {
+			quads = [][4]ID{}
+			return nil
 		}
 
+		lines := strings.Split(string(val), "\n")
+
 		quads = make([][4]ID, len(lines))
 		for i, line := range lines {
 			terms := strings.Split(line, "\t")
@@ -155,7 +163,7 @@ func getQuads(item *badger.Item) (quads [][4]ID, err error) {
 }
 
 func (b *badgerStore) Delete(id ID) (err error) {
-	key := assembleKey(DatasetPrefix, false, id)
+	key := assembleKey(b.prefix, false, id)
 	return b.Badger.Update(func(txn *badger.Txn) error { return txn.Delete(key) })
 }
 
@@ -169,7 +177,7 @@ func (b *badgerStore) Set(id ID, quads [][4]ID) error {
 		lines[i] = strings.Join(line, "\t")
 	}
 	val := strings.Join(lines, "\n")
-	key := assembleKey(DatasetPrefix, false, id)
+	key := assembleKey(b.prefix, false, id)
 	return b.Badger.Update(func(txn *badger.Txn) error { return txn.Set(key, []byte(val)) })
 }
 
@@ -192,11 +200,11 @@ func (b *badgerStore) List(id ID) interface {
 	Next() (id ID, valid bool)
 	Close()
 } {
-	key := assembleKey(DatasetPrefix, false, id)
+	key := assembleKey(b.prefix, false, id)
 	txn := b.Badger.NewTransaction(false)
 	iter := txn.NewIterator(badger.IteratorOptions{
 		PrefetchValues: false,
-		Prefix:         []byte{DatasetPrefix},
+		Prefix:         []byte{b.prefix},
 	})
 	iter.Seek(key)
 	return &badgerList{txn, iter}
@@ -0,0 +1,60 @@
+package styx
+
+import (
+	"context"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// QueryStream runs the query in a goroutine and sends each solution on the
+// returned channel as soon as the solver finds it, keyed by the label of each
+// node in the domain. The channel is unbuffered, so the solver only looks for the
+// next solution after the previous one has been received, and it never holds more
+// than one solution in memory. Both channels are closed when the query is done;
+// at most one error is sent, after the last solution.
+// Cancelling the context stops the goroutine and closes its iterator,
+// even if it's blocked on a send. Consumers that stop reading early must cancel
+// the context, or the goroutine (and its read transaction) will never exit.
+func (s *Store) QueryStream(ctx context.Context, pattern []*rdf.Quad, domain []rdf.Term) (<-chan map[string]rdf.Term, <-chan error) {
+	results, errors := make(chan map[string]rdf.Term), make(chan error, 1)
+	go func() {
+		defer close(errors)
+		defer close(results)
+
+		err := s.stream(ctx, pattern, domain, results)
+		if err != nil {
+			errors <- err
+		}
+	}()
+
+	return results, errors
+}
+
+func (s *Store) stream(ctx context.Context, pattern []*rdf.Quad, domain []rdf.Term, results chan<- map[string]rdf.Term) error {
+	iter, err := s.QueryContext(ctx, pattern, domain, nil)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	domain = iter.Domain()
+	for {
+		d, err := iter.Next(nil)
+		if err != nil {
+			return err
+		} else if d == nil {
+			return nil
+		}
+
+		result := make(map[string]rdf.Term, len(domain))
+		for i, term := range iter.Index() {
+			result[domain[i].Value()] = term
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -2,9 +2,14 @@ package styx
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	badger "github.com/dgraph-io/badger/v2"
 	uuid "github.com/google/uuid"
@@ -20,6 +25,9 @@ const tmpPath = "/tmp/styx"
 type Store struct {
 	Badger *badger.DB
 	Config *Config
+	// Writes read and rewrite count keys that other writes share,
+	// and they aren't always one transaction, so they take turns
+	lock sync.Mutex
 }
 
 // Config contains the initialization options passed to Styx
@@ -27,6 +35,63 @@ type Config struct {
 	TagScheme  TagScheme
 	Dictionary DictionaryFactory
 	QuadStore  QuadStore
+	// Verify makes Set re-read every count key it wrote after committing,
+	// returning ErrInconsistentCount if any of them don't hold the expected value.
+	// The datasets are still written, so the error reports drift without causing any.
+	// Concurrent writers can trigger false positives, so this is mostly useful for testing.
+	Verify bool
+	// Prefixes are the first bytes of the index keys, defaulting to DefaultPrefixes.
+	Prefixes *Prefixes
+	// Reserved are first bytes that the application uses for its own keys
+	// in the same Badger database. NewStore refuses to open the store
+	// if any of styx's prefixes are reserved.
+	Reserved []byte
+	// Logger, if set, receives a line for every constraint of every query when
+	// its iterator is closed, with the count and scan indices it used and its number of reads.
+	Logger Logger
+	// VariablePrefix, if set, makes Query treat the blank nodes of a pattern whose
+	// labels start with it (e.g. "?") as variables, named by the rest of the label.
+	// All other blank nodes stay existentials that only have to be matched.
+	// JSON-LD processing relabels blank nodes, so this only applies to patterns
+	// that are built directly or parsed from N-Quads.
+	VariablePrefix string
+	// NormalizeDateTimes makes Set, Add, and Query rewrite xsd:dateTime literals
+	// with timezones to UTC, so that literals that denote the same instant match
+	// (e.g. "2020-01-01T01:00:00+01:00" and "2020-01-01T00:00:00Z").
+	// It should be set before anything is inserted, since literals that are
+	// already in the database keep the form they were inserted with.
+	NormalizeDateTimes bool
+	// Hash is the hash function for every content-addressed id in the database,
+	// which NewStore passes on to the dictionary (e.g. for the literal ids of
+	// MakeHashDictionary). It defaults to SHA256, and it can't be changed for an
+	// existing database since the ids are part of the index keys: the schema records
+	// the hash of a fixed probe value, and NewStore returns ErrHashMismatch if
+	// the store's hash function digests it differently.
+	Hash HashFunction
+	// OpaquePredicates are predicates whose objects are never queried by value
+	// (e.g. large blobs). Their quads are only indexed by subject and predicate,
+	// which saves the object-leading keys, and Query returns ErrOpaquePredicate
+	// for patterns that use them without a constant subject.
+	// Patterns with a variable predicate don't match them at all, and Query
+	// returns ErrOpaquePredicate for triples without any constant terms.
+	// Like Prefixes, this has to stay the same for an existing database.
+	OpaquePredicates []rdf.Term
+	// Score orders the variables of a query, which are solved in increasing
+	// order of their score. It defaults to NormScore; SelectivityScore does
+	// better on skewed data, where a few large counts hide a small one.
+	Score ScoreFunction
+	// SearchMinLength makes Set and Add index the words of literal objects
+	// that are at least this long, so that Search can find them.
+	// Zero (the default) turns the index off, since it slows down writes.
+	SearchMinLength int
+	// Metrics, if set, receives the number of quads and the duration of every write,
+	// and the planning time, duration, reads, and solutions of every query.
+	Metrics Metrics
+}
+
+// Logger is the interface for query statistics, satisfied by *log.Logger
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 // Close the database
@@ -79,6 +144,57 @@ func NewStore(config *Config, db *badger.DB) (*Store, error) {
 		config.QuadStore = MakeEmptyStore()
 	}
 
+	if config.Hash == nil {
+		config.Hash = SHA256
+	}
+
+	if config.Score == nil {
+		config.Score = NormScore
+	}
+
+	if config.Prefixes == nil {
+		prefixes := DefaultPrefixes
+		config.Prefixes = &prefixes
+	}
+
+	if config.Prefixes.Dataset == 0 {
+		config.Prefixes.Dataset = DatasetPrefix
+	}
+
+	if config.Prefixes.Metadata == 0 {
+		config.Prefixes.Metadata = MetadataPrefix
+	}
+
+	if config.Prefixes.Search == 0 {
+		config.Prefixes.Search = SearchPrefix
+	}
+
+	if config.Prefixes.Range == 0 {
+		config.Prefixes.Range = RangePrefix
+	}
+
+	// The caller's quad store might be shared with other stores,
+	// so one with a different prefix is replaced rather than changed
+	if quads, is := config.QuadStore.(*badgerStore); is && quads.prefix != config.Prefixes.Dataset {
+		config.QuadStore = &badgerStore{Badger: quads.Badger, prefix: config.Prefixes.Dataset}
+	}
+
+	err := config.Prefixes.validate(config.Reserved)
+	if err != nil {
+		return nil, err
+	}
+
+	if db != nil {
+		err = config.Prefixes.checkSchema(db, fingerprint(config.Hash))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if factory, is := config.Dictionary.(*iriDictionaryFactory); is {
+		factory.hash = config.Hash
+	}
+
 	return &Store{
 		Config: config,
 		Badger: db,
@@ -103,12 +219,90 @@ func (s *Store) QueryJSONLD(query interface{}) (*Iterator, error) {
 	return s.Query(quads, nil, nil)
 }
 
-// Query satisfies the Styx interface
+// QueryNTriples exposes a query interface for basic graph patterns written
+// as N-Triples, one triple per line, with variables written as ?name.
+// Blank lines and lines starting with # are ignored.
+func (s *Store) QueryNTriples(pattern string) (*Iterator, error) {
+	quads, err := parsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return s.Query(quads, nil, nil)
+}
+
+// Query satisfies the Styx interface.
+// The iterator reads from a single Badger transaction, which sees a snapshot
+// of the database as of the call to Query: datasets that are set or deleted
+// while it's open don't change its results, and keys it has seeked to can't
+// disappear before it reads their values.
+// A pattern that can't match anything (because a constraint has a count of zero
+// or uses a term that isn't in the database) gives an iterator with no solutions
+// rather than an error, so errors are reserved for invalid queries and failed reads.
+// A triple without constant terms (like ?s ?p ?o) scans every term in the database
+// for whichever of its variables is solved first, so it's slow unless another triple
+// binds one of them. Its variables have to be distinct; Query returns
+// ErrUnboundTriple for a triple like ?s ?p ?s, whose matches Dump enumerates instead.
 func (s *Store) Query(pattern []*rdf.Quad, domain []rdf.Term, index []rdf.Term) (*Iterator, error) {
+	return s.QueryContext(context.Background(), pattern, domain, index)
+}
+
+// QueryContext is like Query, except that the context is checked while the query
+// is planned and every time a variable advances, so cancelling it interrupts a slow
+// join instead of waiting for the next solution. Once the context is done, Next and
+// Seek return its error and the constraints' cursors are closed; the iterator
+// still has to be closed to discard its transaction.
+func (s *Store) QueryContext(ctx context.Context, pattern []*rdf.Quad, domain []rdf.Term, index []rdf.Term) (*Iterator, error) {
 	txn := s.Badger.NewTransaction(false)
 	dictionary := s.Config.Dictionary.Open(false)
-	iter, err := newIterator(pattern, domain, index, s.Config.TagScheme, txn, dictionary)
-	if err != nil {
+	iter, err := s.query(ctx, pattern, domain, index, txn, dictionary, false)
+	if iter == nil {
+		txn.Discard()
+		dictionary.Commit()
+	}
+	return iter, err
+}
+
+// query builds an iterator that reads from the given transaction and dictionary.
+// If borrowed is true, closing the iterator leaves them open for the caller to close,
+// so that several queries can read from the same snapshot.
+func (s *Store) query(
+	ctx context.Context,
+	pattern []*rdf.Quad,
+	domain []rdf.Term,
+	index []rdf.Term,
+	txn *badger.Txn,
+	dictionary Dictionary,
+	borrowed bool,
+) (*Iterator, error) {
+	if s.Config.VariablePrefix != "" {
+		pattern = bindBlankNodes(pattern, s.Config.VariablePrefix)
+	}
+
+	if s.Config.NormalizeDateTimes {
+		pattern = normalizeDateTimes(pattern)
+	}
+
+	for _, quad := range pattern {
+		if s.isOpaque(quad[1]) && isVariable(quad[0]) {
+			return nil, ErrOpaquePredicate
+		} else if len(s.Config.OpaquePredicates) > 0 && isVariable(quad[0]) && isVariable(quad[1]) && isVariable(quad[2]) {
+			// Whether a triple without constant terms reaches the subject-predicate keys
+			// of opaque predicates depends on the order its variables are solved in
+			return nil, ErrOpaquePredicate
+		}
+	}
+
+	started := time.Now()
+	iter, err := newIterator(ctx, pattern, domain, index, s.Config.TagScheme, s.Config.Prefixes, s.Config.Score, txn, dictionary)
+	if iter != nil {
+		iter.borrowed = borrowed
+	}
+
+	if err == nil {
+		iter.logger = s.Config.Logger
+		iter.metrics = s.Config.Metrics
+		iter.started, iter.planning = started, time.Since(started)
+	} else {
 		iter.Close()
 	}
 
@@ -120,6 +314,96 @@ func (s *Store) Query(pattern []*rdf.Quad, domain []rdf.Term, index []rdf.Term)
 	return iter, err
 }
 
+// Ask returns whether the pattern has any solutions. It stops at the first one
+// without resolving its terms, so for a pattern without variables it only costs
+// the count lookups of its constraints.
+func (s *Store) Ask(pattern []*rdf.Quad) (bool, error) {
+	iter, err := s.Query(pattern, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+	return iter.ask()
+}
+
+// ask checks whether the iterator has a solution without resolving its terms
+func (iter *Iterator) ask() (bool, error) {
+	if iter.top || iter.empty {
+		return false, nil
+	} else if iter.Len() == 0 {
+		// Every constraint was a constant with a non-zero count
+		return true, nil
+	}
+
+	tail, err := iter.step(nil)
+	if err != nil {
+		return false, err
+	}
+
+	return tail < iter.Len(), nil
+}
+
+// Explain returns a human-readable dump of the constraint graph that Query builds
+// for the given pattern: the order of the variables, each variable's constraints
+// with their counts and index prefixes, and the dependencies between the variables.
+func (s *Store) Explain(pattern []*rdf.Quad, domain []rdf.Term) (string, error) {
+	iter, err := s.Query(pattern, domain, nil)
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+	return iter.String(), nil
+}
+
+// Analyze runs the query to completion and returns a table of the variables
+// in the order the solver joins them, with the number of cursor advances
+// and the wall-clock time spent seeking each one. The time for a variable only
+// includes its own constraint iterators, so the variable that dominates the
+// table is the join step that dominates the query.
+func (s *Store) Analyze(pattern []*rdf.Quad, domain []rdf.Term) (string, error) {
+	iter, err := s.Query(pattern, domain, nil)
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+
+	if iter.empty {
+		return iter.String(), nil
+	}
+
+	for _, u := range iter.variables {
+		u.analyze = true
+	}
+
+	start := time.Now()
+	err = iter.Seek(nil)
+	if err != nil {
+		return "", err
+	}
+
+	var count int
+	for {
+		d, err := iter.Next(nil)
+		if err != nil {
+			return "", err
+		} else if d == nil {
+			break
+		}
+		count++
+	}
+	elapsed := time.Since(start)
+
+	b := &strings.Builder{}
+	w := tabwriter.NewWriter(b, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "#\tVariable\tConstraints\tAdvances\tElapsed")
+	for i, u := range iter.variables {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\n", i, u.node, u.cs.Len(), u.advances, u.elapsed)
+	}
+	_ = w.Flush()
+	fmt.Fprintf(b, "%d results in %s\n", count, elapsed)
+	return b.String(), nil
+}
+
 // Log will print the *entire database contents* to log
 func (s *Store) Log() {
 	txn := s.Badger.NewTransaction(false)
@@ -157,7 +441,7 @@ func (s *Store) Log() {
 				return
 			}
 			log.Printf("ID to Value: %s <- %s\n", id, string(val))
-		} else if 'a' <= prefix && prefix <= 'c' {
+		} else if bytes.IndexByte(s.Config.Prefixes.Ternary[:], prefix) != -1 {
 			// Ternary key
 			log.Println(
 				"Ternary entry:",
@@ -166,7 +450,7 @@ func (s *Store) Log() {
 				"->",
 				"|"+strings.Replace(strings.Replace(string(val), "\t", " ", -1), "\n", "|", -1),
 			)
-		} else if 'i' <= prefix && prefix <= 'n' {
+		} else if bytes.IndexByte(s.Config.Prefixes.Binary[:], prefix) != -1 {
 			// Binary key
 			log.Println(
 				"Binary entry:",
@@ -175,9 +459,17 @@ func (s *Store) Log() {
 				"->",
 				binary.BigEndian.Uint32(val),
 			)
-		} else if prefix == DatasetPrefix {
+		} else if prefix == s.Config.Prefixes.Dataset {
 			log.Printf("Dataset: %s\n", string(key[1:]))
-		} else if prefix == UnaryPrefix {
+		} else if prefix == s.Config.Prefixes.Metadata {
+			log.Printf("Metadata: %s -> %d bytes\n", string(key[1:]), len(val))
+		} else if prefix == SchemaKey[0] {
+			log.Printf("Schema: %s\n", strings.Replace(strings.TrimSpace(string(val)), "\n", ", ", -1))
+		} else if prefix == s.Config.Prefixes.Search {
+			log.Printf("Search: %s\n", strings.Replace(string(key[1:]), "\t", " ", -1))
+		} else if prefix == s.Config.Prefixes.Range && len(val) > 0 {
+			log.Printf("Range: %s -> %c %x\n", string(key[1:]), val[0], val[1:])
+		} else if prefix == s.Config.Prefixes.Unary {
 			if len(val) != 24 {
 				log.Println("Unexpected index value", val)
 				return
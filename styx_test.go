@@ -1,17 +1,25 @@
 package styx
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	ld "github.com/piprate/json-gold/ld"
 	rdf "github.com/underlay/go-rdfjs"
 )
 
 var d1 = "http://example.com/d1"
 var d2 = "http://example.com/d2"
+var d3 = "http://example.com/d3"
 
 var document1 = `{
 	"@context": {
@@ -48,6 +56,12 @@ var document2 = `{
 	"knows": { "@id": "http://people.com/jane" }
 }`
 
+var document3 = `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/jane",
+	"email": "jane@example.com"
+}`
+
 func open() *Store {
 	fmt.Println("removing path", tmpPath)
 	err := os.RemoveAll(tmpPath)
@@ -81,6 +95,38 @@ func open() *Store {
 	return styx
 }
 
+// openHashed opens a store like open, except that its dictionary
+// stores literals longer than threshold bytes under their hash
+func openHashed(threshold int) *Store {
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(tmpPath))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	tags := NewPrefixTagScheme("http://example.com/")
+	dictionary, err := MakeHashDictionary(tags, db, threshold)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	config := &Config{
+		TagScheme:  tags,
+		Dictionary: dictionary,
+		QuadStore:  MakeBadgerStore(db),
+	}
+
+	styx, err := NewStore(config, db)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return styx
+}
+
 func TestSet(t *testing.T) {
 	styx := open()
 	defer styx.Close()
@@ -295,6 +341,21 @@ func TestDomainQuery(t *testing.T) {
 	}
 
 	iterator.Log()
+
+	// Repeating a term in the domain is invalid with any score function
+	for _, score := range []ScoreFunction{NormScore, SelectivityScore} {
+		styx.Config.Score = score
+		_, err = styx.QuerySPARQL(`SELECT ?s ?s WHERE { ?s <http://schema.org/name> ?n }`)
+		if err != ErrInvalidDomain {
+			t.Errorf("Expected ErrInvalidDomain for a repeated domain term, got %v", err)
+		}
+	}
+
+	for name, score := range map[string]ScoreFunction{"NormScore": NormScore, "SelectivityScore": SelectivityScore} {
+		if value := score(nil); value != 0 {
+			t.Errorf("Expected %s to be 0 without any counts, got %f", name, value)
+		}
+	}
 }
 
 func TestIndexQuery(t *testing.T) {
@@ -329,3 +390,5149 @@ func TestIndexQuery(t *testing.T) {
 
 	iterator.Log()
 }
+
+func TestDuplicateQuery(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	v0 := rdf.NewVariable("v0")
+	name := rdf.NewLiteral("Jane Doe", "", nil)
+	quad := rdf.NewQuad(v0, rdf.NewNamedNode("http://schema.org/name"), name, nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad, quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	if l := iterator.variables[0].cs.Len(); l != 1 {
+		t.Errorf("Expected duplicate quads to collapse into one constraint, got %d", l)
+		return
+	}
+
+	iterator.Log()
+}
+
+func TestTopK(t *testing.T) {
+	// The string dictionary's ids are the terms themselves, so index order is lexical
+	styx, err := NewMemoryStore(&Config{TagScheme: NewPrefixTagScheme("http://example.com/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer styx.Close()
+
+	term := func(name string) rdf.Term { return rdf.NewNamedNode("http://example.com/" + name) }
+	err = styx.Set(rdf.NewNamedNode(d1), []*rdf.Quad{
+		rdf.NewQuad(term("s1"), term("p"), term("o3"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p"), term("o2"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p"), term("o2"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s3"), term("p"), term("o3"), rdf.Default),
+		rdf.NewQuad(term("s4"), term("q"), term("o1"), rdf.Default),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for k, expected := range map[int]map[string]string{
+		// s1 and s2 tie with two objects each, and s3 has fewer than k
+		2:  {"s1": "o1 o2", "s2": "o1 o2", "s3": "o3"},
+		10: {"s1": "o1 o2 o3", "s2": "o1 o2", "s3": "o3"},
+		0:  {"s1": "", "s2": "", "s3": ""},
+	} {
+		result, err := styx.TopK(term("p"), k)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		actual := map[string]string{}
+		for subject, objects := range result {
+			values := make([]string, len(objects))
+			for i, object := range objects {
+				values[i] = strings.TrimPrefix(object.Value(), "http://example.com/")
+			}
+			actual[strings.TrimPrefix(strings.Trim(subject, "<>"), "http://example.com/")] = strings.Join(values, " ")
+		}
+
+		if fmt.Sprint(actual) != fmt.Sprint(expected) {
+			t.Errorf("Expected the top %d to be %v, got %v", k, expected, actual)
+		}
+	}
+
+	result, err := styx.TopK(term("nothing"), 2)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 0 {
+		t.Errorf("Expected no subjects for an unknown predicate, got %v", result)
+	}
+
+	result, err = styx.TopK(term("p"), -1)
+	if err != ErrInvalidInput || result != nil {
+		t.Errorf("Expected ErrInvalidInput for a negative k, got %v and %v", result, err)
+	}
+}
+
+func TestMergeSubjects(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetJSONLD(d3, document3, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	p, o := rdf.NewVariable("p"), rdf.NewVariable("o")
+	jane := rdf.NewNamedNode("http://people.com/jane")
+	iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(jane, p, o, nil)}, nil, nil)
+	defer iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	predicates := map[string]bool{}
+	for d, err := iterator.Next(nil); d != nil; d, err = iterator.Next(nil) {
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		predicates[iterator.Get(p).Value()] = true
+	}
+
+	for _, predicate := range []string{"http://schema.org/name", "http://schema.org/email"} {
+		if !predicates[predicate] {
+			t.Errorf("Expected the merged subject to have a %s value", predicate)
+		}
+	}
+}
+
+var numbers = `{
+	"@context": {
+		"@vocab": "http://schema.org/",
+		"xsd": "http://www.w3.org/2001/XMLSchema#"
+	},
+	"@graph": [
+		{ "@id": "http://example.org/a", "age": { "@value": "22", "@type": "xsd:integer" } },
+		{ "@id": "http://example.org/b", "age": { "@value": "22.0", "@type": "xsd:decimal" } },
+		{ "@id": "http://example.org/c", "age": { "@value": "2.2e1", "@type": "xsd:double" } },
+		{ "@id": "http://example.org/d", "age": { "@value": "23", "@type": "xsd:integer" } }
+	]
+}`
+
+func TestWarm(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// counts returns the count of every constraint that the query planned with
+	counts := func() []uint32 {
+		iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .
+?s <http://schema.org/knows> ?k .`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer iterator.Close()
+
+		result := []uint32{}
+		for _, u := range iterator.variables {
+			for _, c := range u.cs {
+				result = append(result, c.count)
+			}
+		}
+		return result
+	}
+
+	cold := counts()
+
+	keys := [][]byte{[]byte("not a count key")}
+	for _, predicate := range []string{"http://schema.org/name", "http://schema.org/knows"} {
+		key, err := styx.CountKey(SPO, rdf.NewNamedNode(predicate), nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		keys = append(keys, key)
+	}
+
+	err = styx.Warm(keys)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if warm := counts(); len(cold) == 0 || fmt.Sprint(warm) != fmt.Sprint(cold) {
+		t.Errorf("Expected the warm counts %v to match the cold counts %v", warm, cold)
+	}
+}
+
+// birthDateQuery finds the names of the person born on 1996-02-02
+var birthDateQuery = `?s <http://schema.org/name> ?n .
+?s <http://schema.org/birthDate> "1996-02-02"^^<http://www.w3.org/2001/XMLSchema#date> .`
+
+func TestExplain(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(birthDateQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	explanation, err := styx.Explain(pattern, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// ?s has one birth date and two names, so its birth date constraint
+	// (with a count of one) is the first one it seeks
+	sections := strings.Split(explanation, "\n\n")
+	if !strings.Contains(sections[0], "Pivot: 2\n") {
+		t.Errorf("Expected a pivot of 2, got %s", explanation)
+	} else if len(sections) != 3 || !strings.Contains(sections[0], "---- 0: ?s ----") || !strings.Contains(sections[1], "---- 1: ?n ----") {
+		t.Errorf("Expected ?s to be solved before ?n, got %s", explanation)
+	} else if !strings.Contains(sections[0], "Constraints: [ (p0 {<http://schema.org/birthDate>") {
+		t.Errorf("Expected the birth date constraint to be the first of ?s, got %s", sections[0])
+	} else if !strings.Contains(sections[0], "Out: [1]") || !strings.Contains(sections[1], "In: [0]") {
+		t.Errorf("Expected ?n to depend on ?s, got %s", explanation)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(birthDateQuery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	analysis, err := styx.Analyze(pattern, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(analysis), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a header, two variables, and a total, got %s", analysis)
+	} else if !strings.HasPrefix(lines[3], "2 results in ") {
+		t.Errorf("Expected 2 results, got %s", lines[3])
+	}
+
+	// Each row is the index, variable, number of constraints, advances, and elapsed time
+	for i, expected := range [][]string{{"0", "?s", "2"}, {"1", "?n", "1"}} {
+		fields := strings.Fields(lines[i+1])
+		if len(fields) != 5 || strings.Join(fields[:3], " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected row %v, got %q", expected, lines[i+1])
+		} else if fields[3] == "0" {
+			t.Errorf("Expected %s to advance, got %q", expected[1], lines[i+1])
+		} else if _, err := time.ParseDuration(fields[4]); err != nil {
+			t.Errorf("Expected an elapsed time, got %q", fields[4])
+		}
+	}
+
+	// A pattern without results is only explained
+	pattern[1][2] = rdf.NewLiteral("1900-01-01", "", rdf.NewNamedNode(xsdDate))
+	analysis, err = styx.Analyze(pattern, nil)
+	if err != nil {
+		t.Error(err)
+	} else if !strings.Contains(analysis, "Empty") {
+		t.Errorf("Expected an empty constraint graph, got %s", analysis)
+	}
+}
+
+func TestQueryNumeric(t *testing.T) {
+	// With a threshold of one byte, every literal id is a hash
+	for _, styx := range []func() *Store{open, func() *Store { return openHashed(1) }} {
+		testQueryNumeric(t, styx())
+	}
+}
+
+func testQueryNumeric(t *testing.T, styx *Store) {
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, numbers, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, age := rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/age")
+	for _, literal := range []*rdf.Literal{
+		rdf.NewLiteral("22", "", rdf.NewNamedNode("http://www.w3.org/2001/XMLSchema#integer")),
+		rdf.NewLiteral("22.0", "", rdf.NewNamedNode("http://www.w3.org/2001/XMLSchema#decimal")),
+		rdf.NewLiteral("2.2e1", "", rdf.NewNamedNode("http://www.w3.org/2001/XMLSchema#double")),
+	} {
+		result, err := styx.QueryNumeric([]*rdf.Quad{rdf.NewQuad(s, age, literal, nil)}, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(result) != 3 {
+			t.Errorf("Expected %s to match three subjects, got %d", literal.String(), len(result))
+		}
+	}
+
+	// Each literal gets its own variable, even if the pattern already has one with the same label
+	a, b := rdf.NewVariable("numeric0"), rdf.NewVariable("numeric1")
+	integer := func(value string) rdf.Term { return rdf.NewLiteral(value, "", rdf.NewNamedNode(ld.XSDInteger)) }
+	for _, r := range []struct {
+		pattern  []*rdf.Quad
+		expected int
+	}{
+		{[]*rdf.Quad{rdf.NewQuad(a, age, integer("22"), nil), rdf.NewQuad(b, age, integer("23"), nil)}, 3},
+		{[]*rdf.Quad{rdf.NewQuad(a, age, integer("22"), nil), rdf.NewQuad(b, age, integer("24"), nil)}, 0},
+	} {
+		result, err := styx.QueryNumeric(r.pattern, nil)
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != r.expected {
+			t.Errorf("Expected %d results, got %v", r.expected, result)
+		}
+
+		for _, row := range result {
+			if len(row) != 2 || row[1].Value() != "http://example.org/d" {
+				t.Errorf("Expected the results to be projected onto the pattern's variables, got %v", row)
+			}
+		}
+	}
+
+	// The two triples don't share a variable, so when ?b runs out of values it's reset
+	// to its root, and ?y has to be brought back to a value that matches it
+	x, y := rdf.NewVariable("x"), rdf.NewVariable("y")
+	iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(a, age, x, nil), rdf.NewQuad(b, age, y, nil)}, []rdf.Term{a, b}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	solutions := 0
+	for d, err := iterator.Next(nil); d != nil; d, err = iterator.Next(nil) {
+		if err != nil {
+			t.Error(err)
+			break
+		} else if iterator.Get(x) == nil || iterator.Get(y) == nil {
+			t.Errorf("Expected every variable to have a value, got %v", iterator.Get(y))
+		}
+		solutions++
+	}
+
+	if solutions != 16 {
+		t.Errorf("Expected 16 solutions, got %d", solutions)
+	}
+}
+
+func TestEmptyLanguageString(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://example.org/e",
+	"name": { "@value": "", "@language": "en" }
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, name := rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/name")
+	for literal, expected := range map[*rdf.Literal]int{
+		rdf.NewLiteral("", "en", rdf.RDFLangString): 1,
+		rdf.NewLiteral("", "", nil):                 0,
+	} {
+		iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(s, name, literal, nil)}, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(result) != expected {
+			t.Errorf("Expected %d results for %s, got %d", expected, literal.String(), len(result))
+		}
+	}
+}
+
+func TestInvalidLabel(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	name := rdf.NewNamedNode("http://schema.org/name")
+	for _, label := range []string{"a#b", "a?b", ""} {
+		quad := rdf.NewQuad(rdf.NewBlankNode(label), name, rdf.NewVariable("name"), nil)
+		_, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+		if err != ErrInvalidLabel {
+			t.Errorf("Expected ErrInvalidLabel for %q, got %v", label, err)
+		}
+	}
+}
+
+func TestUnboundTriple(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	term := func(name string) rdf.Term { return rdf.NewNamedNode("http://example.com/" + name) }
+	dataset := []*rdf.Quad{
+		rdf.NewQuad(term("s1"), term("p1"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p1"), term("o2"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p1"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p2"), term("s1"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p2"), rdf.NewLiteral("s1", "", nil), rdf.Default),
+	}
+
+	err := styx.Set(rdf.NewNamedNode(d1), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for pattern, expected := range map[string][]string{
+		`?s ?p ?o .`: {
+			"s1 p1 o1", "s1 p1 o2", "s1 p2 \"s1\"", "s2 p1 o1", "s2 p2 s1",
+		},
+		`?s ?p ?o .
+?s <http://example.com/p2> <http://example.com/s1> .`: {
+			"s2 p1 o1", "s2 p2 s1",
+		},
+		`?s ?p ?o .
+<http://example.com/s2> <http://example.com/p1> ?o .`: {
+			"s1 p1 o1", "s2 p1 o1",
+		},
+		`?s ?p ?o .
+?x ?p ?s .`: {
+			"s1 p2 \"s1\"",
+		},
+	} {
+		iterator, err := styx.QueryNTriples(pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		s, p, o := rdf.NewVariable("s"), rdf.NewVariable("p"), rdf.NewVariable("o")
+		result := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+
+			var terms []string
+			for _, term := range []rdf.Term{iterator.Get(s), iterator.Get(p), iterator.Get(o)} {
+				terms = append(terms, strings.TrimPrefix(term.Value(), "http://example.com/"))
+				if term.TermType() == rdf.LiteralType {
+					terms[len(terms)-1] = term.String()
+				}
+			}
+
+			result = append(result, strings.Join(terms, " "))
+		}
+		iterator.Close()
+
+		sort.Strings(result)
+		if strings.Join(result, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("Expected %v for %s, got %v", expected, pattern, result)
+		}
+	}
+
+	// The first term of the unary index isn't a subject, so whichever variable
+	// comes first has to be advanced past its root before the others have values
+	s, p, o := rdf.NewVariable("s"), rdf.NewVariable("p"), rdf.NewVariable("o")
+	for _, domain := range [][]rdf.Term{{s, p, o}, {p, o, s}, {o, s, p}, {o, p, s}} {
+		iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(s, p, o, rdf.Default)}, domain, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != len(dataset) {
+			t.Errorf("Expected %d results in the order %v, got %d", len(dataset), domain, len(result))
+		}
+	}
+
+	// Repeated variables would need every candidate checked against the major index
+	for _, pattern := range []string{`?s ?p ?s .`, `?s ?s ?s .`} {
+		_, err := styx.QueryNTriples(pattern)
+		if err != ErrUnboundTriple {
+			t.Errorf("Expected ErrUnboundTriple for %s, got %v", pattern, err)
+		}
+	}
+}
+
+func TestGetList(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://example.org/playlist",
+	"track": { "@list": ["one", "two", "three"] }
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	list := rdf.NewVariable("list")
+	quad := rdf.NewQuad(rdf.NewNamedNode("http://example.org/playlist"), rdf.NewNamedNode("http://schema.org/track"), list, nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	d, err := iterator.Next(nil)
+	head := iterator.Get(list)
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if d == nil {
+		t.Error("Expected a list head")
+		return
+	}
+
+	terms, err := styx.GetList(head)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []string{"one", "two", "three"}
+	if len(terms) != len(expected) {
+		t.Errorf("Expected %d members, got %d", len(expected), len(terms))
+		return
+	}
+
+	for i, term := range terms {
+		if term.Value() != expected[i] {
+			t.Errorf("Expected %s at %d, got %s", expected[i], i, term.Value())
+		}
+	}
+}
+
+func TestReservedPrefixes(t *testing.T) {
+	_, err := NewMemoryStore(&Config{Reserved: []byte{'a'}})
+	if err != ErrPrefixCollision {
+		t.Errorf("Expected ErrPrefixCollision, got %v", err)
+	}
+
+	prefixes := DefaultPrefixes
+	prefixes.Ternary = [3]byte{'A', 'B', 'C'}
+	styx, err := NewMemoryStore(&Config{
+		TagScheme: NewPrefixTagScheme("http://example.com/"),
+		Prefixes:  &prefixes,
+		Reserved:  []byte{'a', 'b', 'c'},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer styx.Close()
+
+	err = styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := rdf.NewVariable("s")
+	quad := rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/name"), rdf.NewLiteral("Jane Doe", "", nil), nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	}
+}
+
+func TestFirstPerLead(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, name := rdf.NewVariable("s"), rdf.NewVariable("name")
+	quad := rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/name"), name, nil)
+	for lead, expected := range map[bool]int{false: 3, true: 2} {
+		iterator, err := styx.Query([]*rdf.Quad{quad}, []rdf.Term{s, name}, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		iterator.FirstPerLead(lead)
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(result) != expected {
+			t.Errorf("Expected %d results with FirstPerLead(%t), got %d", expected, lead, len(result))
+		}
+	}
+}
+
+func TestQueryUnion(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s := rdf.NewVariable("s")
+	name, familyName := rdf.NewNamedNode("http://schema.org/name"), rdf.NewNamedNode("http://schema.org/familyName")
+	result, err := styx.QueryUnion([][]*rdf.Quad{
+		{rdf.NewQuad(s, name, rdf.NewLiteral("Jane Doe", "", nil), nil)},
+		{rdf.NewQuad(s, familyName, rdf.NewLiteral("Doe", "en", rdf.RDFLangString), nil)},
+		{rdf.NewQuad(s, name, rdf.NewLiteral("John Doe", "", nil), nil)},
+	}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 2 {
+		t.Errorf("Expected 2 results, got %d", len(result))
+	}
+
+	// Variables that a pattern doesn't use are unbound in its solutions
+	x := rdf.NewVariable("x")
+	result, err = styx.QueryUnion([][]*rdf.Quad{
+		{rdf.NewQuad(s, name, rdf.NewLiteral("Jane Doe", "", nil), nil)},
+		{rdf.NewQuad(x, name, rdf.NewLiteral("Jane Doe", "", nil), nil)},
+	}, nil)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 2 {
+		t.Errorf("Expected 2 results, got %v", result)
+	} else if result[0][0] == nil || result[0][1] != nil || result[1][0] != nil || result[1][1] == nil {
+		t.Errorf("Expected ?x and then ?s to be unbound, got %v", result)
+	}
+
+	_, err = styx.QueryUnion([][]*rdf.Quad{
+		{rdf.NewQuad(s, name, rdf.NewLiteral("Jane Doe", "", nil), nil)},
+	}, []rdf.Term{s, x})
+	if err != ErrInvalidDomain {
+		t.Errorf("Expected ErrInvalidDomain, got %v", err)
+	}
+}
+
+func TestSetGraph(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	dataset, err := getDataset(document1, ld.NewJsonLdOptions(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	graph := rdf.NewNamedNode("http://example.org/sources/people")
+	err = styx.SetGraph(rdf.NewNamedNode(d1), graph, fromLdDataset(dataset, ""))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	quad := rdf.NewQuad(rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewLiteral("Jane Doe", "", nil), nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	d, err := iterator.Next(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if d == nil {
+		t.Error("Expected a result")
+		return
+	}
+
+	prov, err := iterator.Prov()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(prov[0]) != 1 || !prov[0][0].Equal(graph) {
+		t.Errorf("Expected the statement to come from %s, got %v", graph.String(), prov[0])
+	}
+}
+
+func TestExecutor(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	executor := styx.NewExecutor(1, 0)
+	quad := rdf.NewQuad(rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewVariable("name"), nil)
+	first, err := executor.Query(context.Background(), []*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = executor.Query(context.Background(), []*rdf.Quad{quad}, nil, nil)
+	if err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+
+	stats := executor.Stats()
+	if stats.Active != 1 || stats.Rejected != 1 {
+		t.Errorf("Unexpected executor stats: %+v", stats)
+	}
+
+	active := executor.ActiveQueries()
+	if len(active) != 1 {
+		t.Errorf("Expected 1 active query, got %d", len(active))
+	} else if !executor.Cancel(active[0].ID) {
+		t.Error("Expected to cancel the active query")
+	} else if _, err = first.Next(nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	first.Close()
+	second, err := executor.Query(context.Background(), []*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	second.Close()
+}
+
+// countdownContext is done with err once its Err has been called a number of times,
+// so that a test can cancel a query at a precise point inside the solver
+type countdownContext struct {
+	context.Context
+	remaining int
+	err       error
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.remaining--; ctx.remaining < 0 {
+		return ctx.err
+	}
+	return nil
+}
+
+func TestQueryContext(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = styx.QueryContext(cancelled, pattern, nil, nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled while planning, got %v", err)
+	}
+
+	ctx := &countdownContext{Context: context.Background(), remaining: 1000, err: context.Canceled}
+	iterator, err := styx.QueryContext(ctx, pattern, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iterator.Close()
+
+	if first, err := iterator.Next(nil); err != nil || first == nil {
+		t.Fatalf("Expected a first result, got %v %v", first, err)
+	}
+
+	// Next checks the context once before solving,
+	// so the second check is inside the solver's loop
+	ctx.remaining = 1
+	if d, err := iterator.Next(nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from the solver, got %v %v", d, err)
+	}
+
+	for _, u := range iterator.variables {
+		for _, c := range u.cs {
+			if c.iterator != nil {
+				t.Errorf("Expected the cursors of %s to be closed", u.node)
+			}
+		}
+	}
+
+	if err = iterator.Seek(nil); err != context.Canceled {
+		t.Errorf("Expected context.Canceled from Seek, got %v", err)
+	}
+}
+
+func TestSelfLoop(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@vocab": "http://schema.org/", "knows": { "@type": "@id" } },
+	"@graph": [
+		{ "@id": "http://example.org/x", "knows": ["http://example.org/x", "http://example.org/y"] },
+		{ "@id": "http://example.org/y", "knows": "http://example.org/x" }
+	]
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	a, knows := rdf.NewVariable("a"), rdf.NewNamedNode("http://schema.org/knows")
+	iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(a, knows, a, nil)}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 1 || result[0][0].Value() != "http://example.org/x" {
+		t.Errorf("Expected only the self-loop on x, got %v", result)
+	}
+}
+
+func TestRelations(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": {
+		"@vocab": "http://schema.org/",
+		"knows": { "@type": "@id" },
+		"follows": { "@type": "@id" },
+		"spouse": { "@type": "@id" }
+	},
+	"@id": "http://example.org/x",
+	"knows": "http://example.org/y",
+	"follows": "http://example.org/y",
+	"spouse": "http://example.org/z"
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	predicates, err := styx.Relations(rdf.NewNamedNode("http://example.org/x"), rdf.NewNamedNode("http://example.org/y"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(predicates) != 2 {
+		t.Errorf("Expected 2 predicates, got %v", predicates)
+	}
+}
+
+func TestDeleteDuringQuery(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	quad := rdf.NewQuad(rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewVariable("name"), nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	d, err := iterator.Next(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if d == nil {
+		t.Error("Expected a result")
+		return
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 2 {
+		t.Errorf("Expected the remaining 2 results from the snapshot, got %d", len(result))
+	}
+}
+
+func TestVariablePrefix(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	styx.Config.VariablePrefix = "?"
+	quad := rdf.NewQuad(rdf.NewBlankNode("?s"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewBlankNode("name"), nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// John has two names but only counts once, since _:name is an existential
+	if len(result) != 2 {
+		t.Errorf("Expected 2 results, got %d", len(result))
+	}
+
+	if domain := iterator.Domain(); !domain[0].Equal(rdf.NewVariable("s")) {
+		t.Errorf("Expected _:?s to be bound as ?s, got %s", domain[0].String())
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key, err := styx.CountKey(SPO, rdf.NewNamedNode("http://people.com/jane"), rdf.NewNamedNode("http://schema.org/name"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stale := []byte{styx.Config.Prefixes.Unary, 'x'}
+	err = styx.Badger.Update(func(txn *badger.Txn) error {
+		if err := txn.Set(key, []byte{0, 0, 0, 99}); err != nil {
+			return err
+		}
+		return txn.Set(stale, make([]byte, 24))
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Refresh()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		} else if binary.BigEndian.Uint32(val) != 1 {
+			t.Errorf("Expected a count of 1, got %d", binary.BigEndian.Uint32(val))
+		}
+
+		if _, err = txn.Get(stale); err != badger.ErrKeyNotFound {
+			t.Errorf("Expected the stale unary key to be deleted, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryNTriples(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`
+# People who know someone named Jane Doe
+?person <http://schema.org/knows> ?friend .
+?friend <http://schema.org/name> "Jane Doe" .
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	}
+
+	_, err = styx.QueryNTriples("?person <http://schema.org/knows>")
+	if err == nil {
+		t.Error("Expected an error for an incomplete triple")
+	}
+}
+
+func TestRepeatedTriple(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	s, p, o := rdf.NewNamedNode("http://example.org/x"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewLiteral("X", "", nil)
+	err := styx.Set(rdf.NewNamedNode(d1), []*rdf.Quad{rdf.NewQuad(s, p, o, rdf.Default), rdf.NewQuad(s, p, o, rdf.Default)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	binaryKey, err := styx.CountKey(SPO, s, p)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	unaryKey, err := styx.CountKey(SPO, s, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(binaryKey)
+		if err != nil {
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		} else if count := binary.BigEndian.Uint32(val); count != 1 {
+			t.Errorf("Expected a binary count of 1, got %d", count)
+		}
+
+		item, err = txn.Get(unaryKey)
+		if err != nil {
+			return err
+		}
+
+		index, err := getUnaryIndex(item)
+		if err != nil {
+			return err
+		} else if index[SPO] != 1 {
+			t.Errorf("Expected a unary count of 1, got %d", index[SPO])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	quad := rdf.NewQuad(rdf.NewVariable("s"), p, o, nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	}
+}
+
+func TestCountKey(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	term := func(value string) rdf.Term { return rdf.NewNamedNode("http://example.com/" + value) }
+	dataset := []*rdf.Quad{}
+	for _, triple := range [][3]string{{"s1", "p1", "o1"}, {"s1", "p1", "o2"}, {"s1", "p2", "o1"}, {"s2", "p1", "o1"}} {
+		dataset = append(dataset, rdf.NewQuad(term(triple[0]), term(triple[1]), term(triple[2]), rdf.Default))
+	}
+
+	err := styx.Set(rdf.NewNamedNode(d1), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	get := func(key []byte) (val []byte, err error) {
+		err = styx.Badger.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err != nil {
+				return err
+			}
+			val, err = item.ValueCopy(nil)
+			return err
+		})
+		return
+	}
+
+	// Each binary key counts the distinct terms that complete its pair
+	for _, c := range []struct {
+		p        Permutation
+		a, b     string
+		expected uint32
+	}{
+		{SPO, "s1", "p1", 2},
+		{SPO, "s1", "p2", 1},
+		{POS, "p1", "o1", 2},
+		{POS, "p1", "o2", 1},
+		{OSP, "o1", "s1", 2},
+		{OSP, "o2", "s1", 1},
+		{SOP, "s1", "o1", 2},
+		{SOP, "s2", "o1", 1},
+		{PSO, "p1", "s1", 2},
+		{PSO, "p2", "s1", 1},
+		{OPS, "o1", "p1", 2},
+		{OPS, "o2", "p1", 1},
+	} {
+		key, err := styx.CountKey(c.p, term(c.a), term(c.b))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		val, err := get(key)
+		if err != nil {
+			t.Errorf("Reading the count of %s %s in permutation %d: %v", c.a, c.b, c.p, err)
+		} else if count := binary.BigEndian.Uint32(val); count != c.expected {
+			t.Errorf("Expected %d for %s %s in permutation %d, got %d", c.expected, c.a, c.b, c.p, count)
+		}
+	}
+
+	// The unary key counts the distinct pairs that start with the term in each permutation
+	key, err := styx.CountKey(SPO, term("s1"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	val, err := get(key)
+	if err != nil {
+		t.Error(err)
+	} else if len(val) != 24 {
+		t.Errorf("Expected a 24-byte unary value, got %v", val)
+	} else {
+		for p, expected := range [6]uint32{2, 0, 0, 2, 0, 0} {
+			if count := binary.BigEndian.Uint32(val[p*4:]); count != expected {
+				t.Errorf("Expected a unary count of %d in permutation %d, got %d", expected, p, count)
+			}
+		}
+	}
+
+	if _, err = styx.CountKey(OPS+1, term("s1"), nil); err != ErrInvalidPermutation {
+		t.Errorf("Expected ErrInvalidPermutation, got %v", err)
+	}
+
+	if _, err = styx.CountKey(SPO, term("s3"), nil); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a term that isn't in the database, got %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetMetadata(rdf.NewNamedNode(d1+"#fragment"), []byte(`{}`))
+	if err != ErrTagScheme {
+		t.Errorf("Expected ErrTagScheme for a node with a fragment, got %v", err)
+	}
+
+	err = styx.SetMetadata(rdf.NewNamedNode(d2), []byte(`{}`))
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a dataset that isn't in the store, got %v", err)
+	}
+
+	node := rdf.NewNamedNode(d1)
+	err = styx.SetMetadata(node, []byte(`{"trust":0.9}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	quad := rdf.NewQuad(rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/name"), rdf.NewLiteral("Jane Doe", "", nil), nil)
+	iterator, err := styx.Query([]*rdf.Quad{quad}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = iterator.Next(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sources, err := iterator.Sources()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(sources[0]) != 1 || !sources[0][0].Equal(node) {
+		t.Errorf("Expected the result to come from %s, got %v", d1, sources[0])
+		return
+	}
+
+	metadata, err := iterator.Metadata(sources[0][0])
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+	} else if string(metadata) != `{"trust":0.9}` {
+		t.Errorf("Unexpected metadata %s", string(metadata))
+	}
+
+	err = styx.Delete(node)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = styx.GetMetadata(node)
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound after deleting the dataset, got %v", err)
+	}
+
+	err = styx.SetMetadata(node, []byte(`{}`))
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a deleted dataset, got %v", err)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples("?person <http://schema.org/knows> ?friend .")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	labels, err := styx.Labels(result, rdf.NewNamedNode("http://schema.org/name"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	label, has := labels["http://people.com/jane"]
+	if !has || label.Value() != "Jane Doe" {
+		t.Errorf("Expected Jane Doe as the label of http://people.com/jane, got %v", labels)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	node := rdf.NewNamedNode(d1)
+	x, knows := rdf.NewNamedNode("http://example.org/x"), rdf.NewNamedNode("http://schema.org/knows")
+	for _, o := range []string{"http://example.org/y", "http://example.org/z"} {
+		err := styx.Add(node, rdf.NewQuad(x, knows, rdf.NewNamedNode(o), rdf.Default))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	quads, err := styx.Get(node)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(quads) != 2 {
+		t.Errorf("Expected 2 quads in the dataset, got %d", len(quads))
+	}
+
+	iterator, err := styx.QueryNTriples("<http://example.org/x> <http://schema.org/knows> ?o .")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 2 {
+		t.Errorf("Expected 2 results, got %d", len(result))
+	}
+}
+
+func TestNormalizeDateTimes(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	styx.Config.NormalizeDateTimes = true
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// document1 was generated at 2019-07-24T16:46:05.751Z
+	iterator, err := styx.QueryNTriples(`?s <http://www.w3.org/ns/prov#generatedAtTime> "2019-07-24T18:46:05.751+02:00"^^<http://www.w3.org/2001/XMLSchema#dateTime> .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	}
+
+	// SetMany normalizes a copy of the datasets, not the caller's
+	quad := rdf.NewQuad(
+		rdf.NewNamedNode("http://example.com/event"),
+		rdf.NewNamedNode("http://schema.org/startDate"),
+		rdf.NewLiteral("2020-01-01T01:00:00+01:00", "", rdf.NewNamedNode(xsdDateTime)),
+		rdf.Default,
+	)
+	datasets := [][]*rdf.Quad{{quad}}
+	err = styx.SetMany([]rdf.Term{rdf.NewNamedNode(d2)}, datasets)
+	if err != nil {
+		t.Error(err)
+	} else if datasets[0][0] != quad {
+		t.Errorf("Expected SetMany to leave the caller's datasets unchanged, got %s", datasets[0][0])
+	}
+}
+
+func TestPartialSolve(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(`
+?a <http://schema.org/knows> ?b .
+?a <http://schema.org/name> ?m .
+?b <http://schema.org/name> ?n .
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Whatever the join order is, there are one or two partial solutions at every depth:
+	// John Doe knows Jane Doe, and John Doe has two names.
+	for depth := 1; depth <= 3; depth++ {
+		result, err := styx.PartialSolve(pattern, depth)
+		if err != nil {
+			t.Error(err)
+			return
+		} else if len(result) < 1 || len(result) > 2 {
+			t.Errorf("Expected 1 or 2 partial results at depth %d, got %d", depth, len(result))
+		} else if len(result[0]) != depth {
+			t.Errorf("Expected %d bindings at depth %d, got %d", depth, depth, len(result[0]))
+		}
+	}
+
+	result, err := styx.PartialSolve(pattern, 10)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 2 {
+		t.Errorf("Expected 2 results, got %d", len(result))
+	} else if result[0]["n"].Value() != "Jane Doe" {
+		t.Errorf("Unexpected binding for n: %v", result[0]["n"])
+	}
+}
+
+func TestSetJSONLDExpect(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	expected := `<http://people.com/jane> <http://schema.org/email> "jane@example.com" .
+`
+
+	err := styx.SetJSONLDExpect(d3, document3, true, expected+`<http://people.com/jane> <http://schema.org/name> "Jane Doe" .
+`)
+	if err != ErrUnexpectedDataset {
+		t.Errorf("Expected ErrUnexpectedDataset, got %v", err)
+	}
+
+	list := styx.List(nil)
+	defer list.Close()
+	if list.Next() != nil {
+		t.Error("Expected the mismatched dataset not to be inserted")
+	}
+
+	err = styx.SetJSONLDExpect(d3, document3, true, expected)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMinSources(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{
+		d1:                      document1,
+		d3:                      document3,
+		"http://example.com/d4": document3,
+	} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	for sources, expected := range []int{5, 5, 1, 0} {
+		iterator, err := styx.QueryNTriples(`<http://people.com/jane> ?p ?o .`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		iterator.MinSources(sources)
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != expected {
+			t.Errorf("Expected %d results with %d sources, got %d", expected, sources, len(result))
+		} else if expected == 1 && result[0][1].Value() != "jane@example.com" {
+			t.Errorf("Unexpected result %v", result[0])
+		}
+	}
+}
+
+func TestHasProperty(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jane := rdf.NewNamedNode("http://people.com/jane")
+	for predicate, expected := range map[string]bool{
+		"http://schema.org/name":    true,
+		"http://schema.org/email":   false,
+		"http://schema.org/unknown": false,
+	} {
+		has, err := styx.HasProperty(jane, rdf.NewNamedNode(predicate))
+		if err != nil {
+			t.Error(err)
+		} else if has != expected {
+			t.Errorf("Expected HasProperty(%s) to be %t", predicate, expected)
+		}
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	has, err := styx.HasProperty(jane, rdf.NewNamedNode("http://schema.org/name"))
+	if err != nil {
+		t.Error(err)
+	} else if has {
+		t.Error("Expected no name after deleting the dataset")
+	}
+}
+
+// BenchmarkStar solves a subject star: one variable bound by a constant
+// and eight object variables that each hang off it with their own predicate.
+// Once ?s has a value, every object variable is a single seek to its own
+// subject-predicate prefix of the ternary index, so the cost per query should
+// stay flat as the number of other subjects and predicates grows.
+func BenchmarkStar(b *testing.B) {
+	styx := open()
+	defer styx.Close()
+
+	const subjects, predicates = 500, 8
+	for i := 0; i < subjects; i++ {
+		subject := rdf.NewNamedNode(fmt.Sprintf("http://example.com/people/%d", i))
+		dataset := make([]*rdf.Quad, predicates)
+		for j := range dataset {
+			predicate := rdf.NewNamedNode(fmt.Sprintf("http://example.com/p%d", j))
+			object := rdf.NewLiteral(fmt.Sprintf("%d-%d", i, j), "", nil)
+			dataset[j] = rdf.NewQuad(subject, predicate, object, rdf.Default)
+		}
+
+		err := styx.Set(rdf.NewNamedNode(fmt.Sprintf("http://example.com/d/%d", i)), dataset)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	s := rdf.NewVariable("s")
+	pattern := []*rdf.Quad{
+		rdf.NewQuad(s, rdf.NewNamedNode("http://example.com/p0"), rdf.NewLiteral("250-0", "", nil), rdf.Default),
+	}
+	for j := 1; j < predicates; j++ {
+		predicate := rdf.NewNamedNode(fmt.Sprintf("http://example.com/p%d", j))
+		pattern = append(pattern, rdf.NewQuad(s, predicate, rdf.NewVariable(fmt.Sprintf("o%d", j)), rdf.Default))
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			b.Fatal(err)
+		} else if len(result) != 1 {
+			b.Fatalf("Expected 1 result, got %d", len(result))
+		}
+	}
+}
+
+func BenchmarkScore(b *testing.B) {
+	styx := open()
+	defer styx.Close()
+
+	// Every person has one of a few colors but a unique name,
+	// so the star is much cheaper to solve starting from the subject
+	const subjects, colors = 500, 5
+	for i := 0; i < subjects; i++ {
+		subject := rdf.NewNamedNode(fmt.Sprintf("http://example.com/people/%d", i))
+		dataset := []*rdf.Quad{
+			rdf.NewQuad(subject, rdf.NewNamedNode("http://example.com/color"), rdf.NewLiteral(fmt.Sprintf("%d", i%colors), "", nil), rdf.Default),
+			rdf.NewQuad(subject, rdf.NewNamedNode("http://example.com/name"), rdf.NewLiteral(fmt.Sprintf("%d", i), "", nil), rdf.Default),
+		}
+
+		err := styx.Set(rdf.NewNamedNode(fmt.Sprintf("http://example.com/d/%d", i)), dataset)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	s, color, name := rdf.NewVariable("s"), rdf.NewVariable("color"), rdf.NewVariable("name")
+	pattern := []*rdf.Quad{
+		rdf.NewQuad(s, rdf.NewNamedNode("http://example.com/color"), color, rdf.Default),
+		rdf.NewQuad(s, rdf.NewNamedNode("http://example.com/name"), name, rdf.Default),
+	}
+
+	for label, score := range map[string]ScoreFunction{
+		"norm":        NormScore,
+		"selectivity": SelectivityScore,
+		"worst":       func(counts []uint32) float64 { return -SelectivityScore(counts) },
+	} {
+		b.Run(label, func(b *testing.B) {
+			styx.Config.Score = score
+			for n := 0; n < b.N; n++ {
+				iterator, err := styx.Query(pattern, nil, nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				result, err := iterator.Collect()
+				iterator.Close()
+				if err != nil {
+					b.Fatal(err)
+				} else if len(result) != subjects {
+					b.Fatalf("Expected %d results, got %d", subjects, len(result))
+				}
+			}
+		})
+	}
+}
+
+func TestDeletePreview(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{
+		d1:                      document1,
+		d3:                      document3,
+		"http://example.com/d4": document3,
+	} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	plan, err := styx.DeletePreview(rdf.NewNamedNode(d3))
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(plan.Statements) != 1 || len(plan.Quads) != 0 || len(plan.Keys) != 0 {
+		t.Errorf("Unexpected plan for a corroborated dataset: %v", plan)
+	}
+
+	plan, err = styx.DeletePreview(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(plan.Statements) == 0 || len(plan.Quads) != len(plan.Statements) || len(plan.Keys) == 0 {
+		t.Errorf("Unexpected plan: %v", plan)
+		return
+	}
+
+	jane, name := rdf.NewNamedNode("http://people.com/jane"), rdf.NewNamedNode("http://schema.org/name")
+	if has, _ := styx.HasProperty(jane, name); !has {
+		t.Error("Expected the preview not to delete anything")
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		for _, key := range plan.Keys {
+			_, err := txn.Get(key)
+			if err != badger.ErrKeyNotFound {
+				t.Errorf("Expected count key %v to be deleted", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHashFunction(t *testing.T) {
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(tmpPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := NewPrefixTagScheme("http://example.com/")
+	dictionary, err := MakeHashDictionary(tags, db, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashed := map[string]bool{}
+	config := &Config{
+		TagScheme:  tags,
+		Dictionary: dictionary,
+		QuadStore:  MakeBadgerStore(db),
+		Hash: func(data []byte) []byte {
+			hashed[string(data)] = true
+			return SHA256(data)
+		},
+	}
+
+	styx, err := NewStore(config, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer styx.Close()
+
+	err = styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !hashed[`"Johnny Doe"`] {
+		t.Error("Expected the configured hash function to be used for long literals")
+	}
+
+	// The schema records the hash function, so another store on the database has to
+	// hash the same way, whichever function value it uses
+	_, err = NewStore(&Config{TagScheme: tags, Dictionary: dictionary, QuadStore: MakeBadgerStore(db), Hash: func(data []byte) []byte {
+		hash := SHA256(data)
+		return hash[:16]
+	}}, db)
+	if err != ErrHashMismatch {
+		t.Errorf("Expected ErrHashMismatch, got %v", err)
+	}
+
+	_, err = NewStore(&Config{TagScheme: tags, Dictionary: dictionary, QuadStore: MakeBadgerStore(db)}, db)
+	if err != nil {
+		t.Error(err)
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> "Johnny Doe" .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	}
+}
+
+func TestHashDictionaryDelete(t *testing.T) {
+	styx := openHashed(8)
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	names := func() map[string]bool {
+		result := map[string]bool{}
+		iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+		if err != nil {
+			t.Error(err)
+			return result
+		}
+		defer iterator.Close()
+
+		values, err := iterator.Collect()
+		if err != nil {
+			t.Error(err)
+		}
+		for _, value := range values {
+			result[value[1].Value()] = true
+		}
+		return result
+	}
+
+	// "Johnny Doe" is longer than the threshold and "Jane Doe" isn't
+	if n := names(); len(n) != 3 || !n["Johnny Doe"] || !n["Jane Doe"] {
+		t.Errorf("Expected the hashed and inline names to round-trip, got %v", n)
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> "Johnny Doe" .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	result, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result for the hashed literal, got %d", len(result))
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if n := names(); len(n) != 0 {
+		t.Errorf("Expected no names after deleting the dataset, got %v", n)
+	}
+
+	prefixes := styx.Config.Prefixes
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			key := iter.Item().Key()
+			if key[0] == prefixes.Unary || bytes.IndexByte(prefixes.Binary[:], key[0]) != -1 || bytes.IndexByte(prefixes.Ternary[:], key[0]) != -1 {
+				t.Errorf("Expected every index key to be deleted, found %q", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWithObject(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetJSONLD(d2, document2, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jane := rdf.NewNamedNode("http://people.com/jane")
+	quads, err := styx.WithObject(jane)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(quads) != 2 {
+		t.Errorf("Expected 2 quads, got %d", len(quads))
+	}
+
+	for _, quad := range quads {
+		if quad[1].Value() != "http://schema.org/knows" || !quad[2].Equal(jane) {
+			t.Errorf("Unexpected quad %s", quad.String())
+		}
+	}
+
+	quads, err = styx.WithObject(rdf.NewNamedNode("http://people.com/nobody"))
+	if err != nil {
+		t.Error(err)
+	} else if len(quads) != 0 {
+		t.Errorf("Expected no quads, got %d", len(quads))
+	}
+}
+
+func TestIncluded(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@version": 1.1, "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/john",
+	"name": "John Doe",
+	"knows": { "@id": "http://people.com/jane" },
+	"@included": [
+		{ "@id": "http://people.com/jane", "name": "Jane Doe" }
+	]
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`
+<http://people.com/john> <http://schema.org/knows> ?p .
+?p <http://schema.org/name> ?n .
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+	} else if name := result[0][1]; name.Value() != "Jane Doe" {
+		t.Errorf("Unexpected name %v", name)
+	}
+}
+
+func TestSkolemBindings(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> "John Doe" .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(result) != 1 {
+		t.Errorf("Expected 1 result, got %d", len(result))
+		return
+	}
+
+	john := result[0][0]
+	if john.TermType() != rdf.NamedNodeType || !strings.HasPrefix(john.Value(), d1+"#") {
+		t.Errorf("Expected a skolem IRI, got %s", john.String())
+		return
+	}
+
+	iterator, err = styx.Query([]*rdf.Quad{
+		rdf.NewQuad(john, rdf.NewNamedNode("http://schema.org/birthDate"), rdf.NewVariable("b"), rdf.Default),
+	}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err = iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 || result[0][0].Value() != "1996-02-02" {
+		t.Errorf("Unexpected result %v", result)
+	}
+}
+
+func TestVerifier(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	wait := func(v *Verifier, done func(VerifierStats) bool) VerifierStats {
+		deadline := time.Now().Add(5 * time.Second)
+		for stats := v.Stats(); time.Now().Before(deadline); stats = v.Stats() {
+			if done(stats) {
+				return stats
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Error("Timed out waiting for the verifier")
+		return v.Stats()
+	}
+
+	if _, err = styx.StartVerifier(0, true); err != ErrInvalidInterval {
+		t.Errorf("Expected ErrInvalidInterval, got %v", err)
+	}
+
+	v, err := styx.StartVerifier(time.Microsecond, true)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stats := wait(v, func(stats VerifierStats) bool { return stats.Passes > 0 })
+	if stats.Inconsistent != 0 {
+		t.Errorf("Expected no inconsistent keys, got %d", stats.Inconsistent)
+	}
+
+	key, err := styx.CountKey(SPO, rdf.NewNamedNode("http://people.com/jane"), rdf.NewNamedNode("http://schema.org/name"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.Update(func(txn *badger.Txn) error { return txn.Set(key, []byte{0, 0, 0, 99}) })
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	wait(v, func(stats VerifierStats) bool { return stats.Inconsistent > 0 })
+	v.Stop()
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		} else if binary.BigEndian.Uint32(val) != 1 {
+			t.Errorf("Expected the verifier to repair the count, got %d", binary.BigEndian.Uint32(val))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// A repair only rewrites the key that the verifier found
+	other, err := styx.CountKey(SPO, rdf.NewNamedNode("http://people.com/jane"), rdf.NewNamedNode("http://schema.org/birthDate"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.Update(func(txn *badger.Txn) error {
+		for _, k := range [][]byte{key, other} {
+			if err := txn.Set(k, []byte{0, 0, 0, 99}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = v.repairCount(key)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		for k, expected := range map[string]uint32{string(key): 1, string(other): 99} {
+			item, err := txn.Get([]byte(k))
+			if err != nil {
+				return err
+			}
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			} else if binary.BigEndian.Uint32(val) != expected {
+				t.Errorf("Expected %q to count %d, got %d", k, expected, binary.BigEndian.Uint32(val))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// driftingStore overwrites a count key whenever a dataset is written,
+// like a concurrent writer that changes it between Set's commit and its verification
+type driftingStore struct {
+	QuadStore
+	db  *badger.DB
+	key []byte
+}
+
+func (d *driftingStore) Set(id ID, quads [][4]ID) error {
+	err := d.QuadStore.Set(id, quads)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(txn *badger.Txn) error { return txn.Set(d.key, make([]byte, 24)) })
+}
+
+func TestVerify(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	styx.Config.Verify = true
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	key, err := styx.CountKey(SPO, rdf.NewNamedNode("http://people.com/jane"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	styx.Config.QuadStore = &driftingStore{QuadStore: styx.Config.QuadStore, db: styx.Badger, key: key}
+	err = styx.SetJSONLD(d2, document2, false)
+	if err != ErrInconsistentCount {
+		t.Errorf("Expected ErrInconsistentCount, got %v", err)
+	}
+
+	// The index keys were committed, so the dataset has to be there too
+	quads, err := styx.Get(rdf.NewNamedNode(d2))
+	if err != nil {
+		t.Error(err)
+	} else if len(quads) == 0 {
+		t.Error("Expected the dataset to be written despite the inconsistent count")
+	}
+}
+
+func TestOpaquePredicates(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	birthDate := rdf.NewNamedNode("http://schema.org/birthDate")
+	styx.Config.OpaquePredicates = []rdf.Term{birthDate}
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	date := rdf.NewLiteral("1995-01-01", "", rdf.NewNamedNode(ld.XSDNS+"date"))
+	jane := rdf.NewNamedNode("http://people.com/jane")
+	quads, err := styx.WithObject(date)
+	if err != nil {
+		t.Error(err)
+	} else if len(quads) != 1 || !quads[0][0].Equal(jane) || !quads[0][1].Equal(birthDate) {
+		t.Errorf("Expected the opaque triple with jane's birth date, got %v", quads)
+	}
+
+	predicates, err := styx.Relations(jane, date)
+	if err != nil {
+		t.Error(err)
+	} else if len(predicates) != 1 || !predicates[0].Equal(birthDate) {
+		t.Errorf("Expected the opaque predicate to relate jane to her birth date, got %v", predicates)
+	}
+
+	_, err = styx.Query([]*rdf.Quad{rdf.NewQuad(rdf.NewVariable("s"), birthDate, date, rdf.Default)}, nil, nil)
+	if err != ErrOpaquePredicate {
+		t.Errorf("Expected ErrOpaquePredicate, got %v", err)
+	}
+
+	_, err = styx.QueryNTriples(`?s ?p ?o .`)
+	if err != ErrOpaquePredicate {
+		t.Errorf("Expected ErrOpaquePredicate for a triple without constant terms, got %v", err)
+	}
+
+	iterator, err := styx.Query([]*rdf.Quad{rdf.NewQuad(jane, birthDate, rdf.NewVariable("d"), rdf.Default)}, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 || !result[0][0].Equal(date) {
+		t.Errorf("Unexpected result %v", result)
+	}
+
+	if has, _ := styx.HasProperty(jane, birthDate); !has {
+		t.Error("Expected jane to have a birth date")
+	}
+
+	err = styx.Refresh()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if key := iter.Item().Key(); bytes.IndexByte(styx.Config.Prefixes.Binary[:], key[0]) != -1 {
+				t.Errorf("Expected every count key to be deleted, found %q", key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(all) != 3 {
+		t.Errorf("Expected 3 results, got %d", len(all))
+		return
+	}
+
+	for _, page := range []struct{ limit, expected int }{
+		{0, 3},
+		{1, 1},
+		{2, 2},
+		{3, 3},
+		{5, 3},
+	} {
+		iterator.Limit(page.limit)
+
+		// The limit counts from the most recent Seek, so every pass gets the same results
+		for pass := 0; pass < 2; pass++ {
+			err = iterator.Seek(nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			result, err := iterator.Collect()
+			if err != nil {
+				t.Error(err)
+			} else if len(result) != page.expected {
+				t.Errorf("Expected %d results with limit %d, got %d", page.expected, page.limit, len(result))
+			} else {
+				for i, index := range result {
+					if index[1].Value() != all[i][1].Value() {
+						t.Errorf("Expected result %d with limit %d to be %v, got %v", i, page.limit, all[i], index)
+					}
+				}
+			}
+
+			if d, err := iterator.Next(nil); err != nil || d != nil {
+				t.Errorf("Expected no more results with limit %d, got %v and %v", page.limit, d, err)
+			}
+		}
+	}
+}
+
+func TestOffset(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(all) != 3 {
+		t.Errorf("Expected 3 results, got %d", len(all))
+		return
+	}
+
+	for _, page := range []struct{ offset, limit, expected int }{
+		{1, 0, 2},
+		{1, 1, 1},
+		{2, 5, 1},
+		{3, 0, 0},
+		{5, 1, 0},
+	} {
+		iterator.Offset(page.offset)
+		iterator.Limit(page.limit)
+		err = iterator.Seek(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result, err := iterator.Collect()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != page.expected {
+			t.Errorf("Expected %d results with offset %d and limit %d, got %d", page.expected, page.offset, page.limit, len(result))
+		} else if len(result) > 0 && result[0][1].Value() != all[page.offset][1].Value() {
+			t.Errorf("Expected the result at offset %d, got %v", page.offset, result[0])
+		}
+	}
+}
+
+func TestRetract(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err := styx.RetractJSONLD(d2, `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"knows": { "@id": "http://people.com/jane" }
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dataset, err := styx.Get(rdf.NewNamedNode(d2))
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(dataset) != 3 {
+		t.Errorf("Expected 3 quads to remain, got %d", len(dataset))
+	}
+
+	quads, err := styx.WithObject(rdf.NewNamedNode("http://people.com/jane"))
+	if err != nil {
+		t.Error(err)
+	} else if len(quads) != 1 {
+		t.Errorf("Expected only d1 to know jane, got %d quads", len(quads))
+	}
+
+	err = styx.Retract(rdf.NewNamedNode(d2), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = styx.Get(rdf.NewNamedNode(d2))
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	// Retract normalizes the quads like Set does, so the
+	// dateTime matches the normalized one that Set stored
+	styx.Config.NormalizeDateTimes = true
+	event := rdf.NewNamedNode("http://example.com/events/a")
+	start := rdf.NewQuad(event, rdf.NewNamedNode("http://schema.org/startDate"), rdf.NewLiteral("2019-12-31T19:00:00-05:00", "", rdf.NewNamedNode(xsdDateTime)), rdf.Default)
+	name := rdf.NewQuad(event, rdf.NewNamedNode("http://schema.org/name"), rdf.NewLiteral("New Year", "", nil), rdf.Default)
+	err = styx.Set(rdf.NewNamedNode(d3), []*rdf.Quad{start, name})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Retract(rdf.NewNamedNode(d3), []*rdf.Quad{start})
+	if err != nil {
+		t.Error(err)
+	} else if dataset, err := styx.Get(rdf.NewNamedNode(d3)); err != nil {
+		t.Error(err)
+	} else if len(dataset) != 1 || dataset[0].String() != name.String() {
+		t.Errorf("Expected only the name to remain, got %v", dataset)
+	}
+}
+
+func TestDump(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d3: document3} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	var b strings.Builder
+	err := styx.Dump(&b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := `<http://people.com/jane> <http://schema.org/email> "jane@example.com" <http://example.com/d3#> .`
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	found := false
+	for _, line := range lines {
+		if rdf.ParseQuad(line) == nil {
+			t.Errorf("Invalid N-Quads line: %s", line)
+		}
+		found = found || line == expected
+	}
+
+	if !found {
+		t.Errorf("Expected the dump to contain %s", expected)
+	}
+
+	dataset, _ := styx.Get(rdf.NewNamedNode(d1))
+	if len(lines) != len(dataset)+1 {
+		t.Errorf("Expected %d lines, got %d", len(dataset)+1, len(lines))
+	}
+}
+
+func TestLiteralDatatypes(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@vocab": "http://schema.org/", "xsd": "http://www.w3.org/2001/XMLSchema#" },
+	"@id": "http://people.com/john",
+	"age": [
+		{ "@value": "22", "@type": "xsd:integer" },
+		{ "@value": "22" }
+	]
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for pattern, expected := range map[string]int{
+		`<http://people.com/john> <http://schema.org/age> ?a .`:                         2,
+		`?s <http://schema.org/age> "22" .`:                                             1,
+		`?s <http://schema.org/age> "22"^^<http://www.w3.org/2001/XMLSchema#integer> .`: 1,
+		`?s <http://schema.org/age> "22"^^<http://www.w3.org/2001/XMLSchema#decimal> .`: 0,
+		`?s <http://schema.org/age> "22"@en .`:                                          0,
+	} {
+		iterator, err := styx.QueryNTriples(pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != expected {
+			t.Errorf("Expected %d results for %s, got %d", expected, pattern, len(result))
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetJSONLD(d2, `{
+	"@context": { "@vocab": "http://schema.org/", "xsd": "http://www.w3.org/2001/XMLSchema#" },
+	"@graph": [
+		{ "@id": "http://people.com/a", "age": { "@value": "-5", "@type": "xsd:integer" } },
+		{ "@id": "http://people.com/b", "age": { "@value": "3", "@type": "xsd:integer" } },
+		{ "@id": "http://people.com/c", "age": { "@value": "21", "@type": "xsd:integer" } },
+		{ "@id": "http://people.com/d", "age": { "@value": "22", "@type": "xsd:integer" } },
+		{ "@id": "http://people.com/e", "age": { "@value": "30.5", "@type": "xsd:decimal" } },
+		{ "@id": "http://people.com/f", "age": "unknown" }
+	]
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	integer := func(value string) rdf.Term { return rdf.NewLiteral(value, "", rdf.NewNamedNode(ld.XSDInteger)) }
+	date := func(value string) rdf.Term { return rdf.NewLiteral(value, "", rdf.NewNamedNode(xsdDate)) }
+
+	for _, r := range []struct {
+		pattern  string
+		min, max rdf.Term
+		expected int
+	}{
+		{`?s <http://schema.org/age> ?x .`, integer("21"), nil, 3},
+		{`?s <http://schema.org/age> ?x .`, nil, integer("0"), 1},
+		{`?s <http://schema.org/age> ?x .`, integer("-10"), integer("21"), 3},
+		{`?s <http://schema.org/birthDate> ?x .`, date("1995-06-01"), nil, 1},
+		{`?s <http://schema.org/birthDate> ?x .`, nil, nil, 2},
+	} {
+		iterator, err := styx.QueryNTriples(r.pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Range(rdf.NewVariable("x"), r.min, r.max)
+		if err != nil {
+			t.Error(err)
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != r.expected {
+			t.Errorf("Expected %d results between %v and %v, got %d", r.expected, r.min, r.max, len(result))
+		}
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/age> ?x .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	err = iterator.Range(rdf.NewVariable("x"), integer("1"), date("2000-01-01"))
+	if err != ErrInvalidRange {
+		t.Errorf("Expected ErrInvalidRange, got %v", err)
+	}
+
+	double := rdf.NewLiteral("NaN", "", rdf.NewNamedNode(ld.XSDDouble))
+	if err = iterator.Range(rdf.NewVariable("x"), double, nil); err != ErrInvalidRange {
+		t.Errorf("Expected ErrInvalidRange for NaN, got %v", err)
+	}
+
+	// The ranged variable comes after ?s, so its range constraint
+	// is intersected with the values that ?s pushes to it
+	age := rdf.NewNamedNode("http://schema.org/age")
+	s, x, y := rdf.NewVariable("s"), rdf.NewVariable("x"), rdf.NewVariable("y")
+	pattern := []*rdf.Quad{rdf.NewQuad(s, age, x, rdf.Default), rdf.NewQuad(s, age, y, rdf.Default)}
+	decimal := rdf.NewLiteral("21.5", "", rdf.NewNamedNode(ld.XSDDecimal))
+	ranged, err := styx.Query(pattern, []rdf.Term{s, x, y}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer ranged.Close()
+
+	if err = ranged.Range(y, decimal, nil); err != nil {
+		t.Error(err)
+	} else if result, err := ranged.Collect(); err != nil {
+		t.Error(err)
+	} else if len(result) != 2 {
+		t.Errorf("Expected 2 results above 21.5, got %v", result)
+	}
+
+	// Range only sees the literals in the range index, which Refresh fills in
+	err = styx.Badger.DropPrefix([]byte{RangePrefix})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []int{0, 3} {
+		iterator, err := styx.QueryNTriples(`?s <http://schema.org/age> ?x .`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Range(rdf.NewVariable("x"), integer("21"), nil)
+		if err != nil {
+			t.Error(err)
+		} else if result, err := iterator.Collect(); err != nil {
+			t.Error(err)
+		} else if len(result) != expected {
+			t.Errorf("Expected %d results at or above 21, got %d", expected, len(result))
+		}
+		iterator.Close()
+
+		if err = styx.Refresh(); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Retracting and deleting the ages removes their range keys
+	rangeKeys := func() (count int) {
+		err := styx.Badger.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{RangePrefix}})
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				count++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	before := rangeKeys()
+	err = styx.Retract(rdf.NewNamedNode(d2), []*rdf.Quad{
+		rdf.NewQuad(rdf.NewNamedNode("http://people.com/a"), age, integer("-5"), rdf.Default),
+	})
+	if err != nil {
+		t.Error(err)
+	} else if after := rangeKeys(); after != before-1 {
+		t.Errorf("Expected %d range keys after retracting an age, got %d", before-1, after)
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d2))
+	if err != nil {
+		t.Error(err)
+	} else if after := rangeKeys(); after != before-5 {
+		t.Errorf("Expected %d range keys after deleting the ages, got %d", before-5, after)
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/gabriel",
+	"name": [
+		{ "@value": "Gabriel", "@language": "es" },
+		{ "@value": "Gabriel", "@language": "en" },
+		"Gabriel"
+	]
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for language, expected := range map[string]int{"es": 1, "EN": 1, "": 1, "fr": 0} {
+		iterator, err := styx.QueryNTriples(`<http://people.com/gabriel> <http://schema.org/name> ?n .`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Language(rdf.NewVariable("n"), language)
+		if err != nil {
+			t.Error(err)
+		}
+
+		result, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(result) != expected {
+			t.Errorf("Expected %d results for language %q, got %d", expected, language, len(result))
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{
+		d1:                      document1,
+		d3:                      document3,
+		"http://example.com/d4": document3,
+	} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	jane := rdf.NewNamedNode("http://people.com/jane")
+	email := rdf.NewNamedNode("http://schema.org/email")
+	sources, err := styx.Sources(rdf.NewQuad(jane, email, rdf.NewLiteral("jane@example.com", "", nil), rdf.Default))
+	if err != nil {
+		t.Error(err)
+	} else if len(sources) != 2 {
+		t.Errorf("Expected 2 sources, got %d", len(sources))
+	}
+
+	sources, err = styx.Sources(rdf.NewQuad(jane, email, rdf.NewLiteral("john@example.com", "", nil), rdf.Default))
+	if err != nil {
+		t.Error(err)
+	} else if sources == nil || len(sources) != 0 {
+		t.Errorf("Expected no sources, got %v", sources)
+	}
+}
+
+func TestSetMany(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLDMany([]string{d1, d2, d3}, []interface{}{document1, document2, document3}, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	nodes := []rdf.Term{rdf.NewNamedNode(d1), rdf.NewNamedNode(d2), rdf.NewNamedNode(d3)}
+	datasets := make([][]*rdf.Quad, len(nodes))
+	for i, document := range []string{document1, document2, document3} {
+		dataset, err := getDataset(document, ld.NewJsonLdOptions(nodes[i].Value()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		datasets[i] = fromLdDataset(dataset, "")
+	}
+
+	// The second batch replaces the first two datasets with each other's contents
+	for _, batch := range [][]int{{0, 1, 2}, {1, 0, 2}} {
+		values := make([][]*rdf.Quad, len(batch))
+		for i, j := range batch {
+			values[i] = datasets[j]
+		}
+
+		err := styx.SetMany(nodes, values)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for i, node := range nodes {
+			dataset, err := styx.Get(node)
+			if err != nil {
+				t.Error(err)
+			} else if len(dataset) != len(values[i]) {
+				t.Errorf("Expected %d quads in %s, got %d", len(values[i]), node.Value(), len(dataset))
+			}
+		}
+
+		err = styx.Badger.View(func(txn *badger.Txn) error {
+			prefixes := styx.Config.Prefixes
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().KeyCopy(nil)
+				if key[0] != prefixes.Unary && bytes.IndexByte(prefixes.Binary[:], key[0]) == -1 {
+					continue
+				}
+
+				val, err := iter.Item().ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				if !verifyCount(key, val, prefixes, txn) {
+					t.Errorf("Inconsistent count key %q", key)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = styx.SetMany([]rdf.Term{nodes[0], nodes[0]}, [][]*rdf.Quad{datasets[0], datasets[1]})
+	if err != ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput, got %v", err)
+	}
+}
+
+func TestStableCounts(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	counts := func() map[string]string {
+		result := map[string]string{}
+		err := styx.Badger.View(func(txn *badger.Txn) error {
+			prefixes := styx.Config.Prefixes
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().KeyCopy(nil)
+				if key[0] == prefixes.Unary || bytes.IndexByte(prefixes.Binary[:], key[0]) != -1 {
+					val, err := iter.Item().ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					result[string(key)] = string(val)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return result
+	}
+
+	compare := func(expected map[string]string) {
+		actual := counts()
+		if len(actual) != len(expected) {
+			t.Errorf("Expected %d count keys, got %d", len(expected), len(actual))
+		}
+		for key, val := range actual {
+			if expected[key] != val {
+				t.Errorf("Count key %q changed from %v to %v", key, []byte(expected[key]), []byte(val))
+			}
+		}
+	}
+
+	for _, uri := range []string{d1, d3} {
+		err := styx.SetJSONLD(uri, document1, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	// Setting the same document at the same node again doesn't change any counts
+	expected := counts()
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compare(expected)
+
+	// Neither does another source for a document without blank nodes,
+	// since every one of its triples is already in the database
+	err = styx.SetJSONLD(d2, document3, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected = counts()
+	err = styx.SetJSONLD("http://example.com/d4", document3, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	compare(expected)
+
+	sources, err := styx.Sources(rdf.NewQuad(
+		rdf.NewNamedNode("http://people.com/jane"),
+		rdf.NewNamedNode("http://schema.org/name"),
+		rdf.NewLiteral("Jane Doe", "", nil),
+		rdf.Default,
+	))
+	if err != nil {
+		t.Error(err)
+	} else if len(sources) != 2 {
+		t.Errorf("Expected 2 sources, got %d", len(sources))
+	}
+}
+
+func TestResetDataset(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	term := func(name string) rdf.Term { return rdf.NewNamedNode("http://example.com/" + name) }
+	quad := func(s, p, o string) *rdf.Quad { return rdf.NewQuad(term(s), term(p), term(o), rdf.Default) }
+
+	// versions maps every key with one of the given prefixes to its version
+	versions := func(prefixes ...byte) map[string]uint64 {
+		result := map[string]uint64{}
+		err := styx.Badger.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.IteratorOptions{})
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				if bytes.IndexByte(prefixes, iter.Item().Key()[0]) != -1 {
+					result[string(iter.Item().KeyCopy(nil))] = iter.Item().Version()
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return result
+	}
+
+	counts := func() map[string]string {
+		result := map[string]string{}
+		prefixes := styx.Config.Prefixes
+		err := styx.Badger.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().KeyCopy(nil)
+				if key[0] == prefixes.Unary || bytes.IndexByte(prefixes.Binary[:], key[0]) != -1 {
+					val, err := iter.Item().ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					result[string(key)] = string(val)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return result
+	}
+
+	node := rdf.NewNamedNode(d1)
+	err := styx.Set(node, []*rdf.Quad{quad("s1", "p1", "o1"), quad("s1", "p1", "o2"), quad("s2", "p2", "o1")})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	minor := styx.Config.Prefixes.Ternary[1:]
+	before := versions(minor...)
+
+	// The second and third quads are in both versions of the dataset
+	err = styx.Set(node, []*rdf.Quad{quad("s1", "p1", "o2"), quad("s2", "p2", "o1"), quad("s2", "p1", "o2")})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	after := versions(minor...)
+	kept := 0
+	for key, version := range after {
+		if before[key] == version {
+			kept++
+		}
+	}
+
+	// Two permutations of the two shared triples weren't rewritten,
+	// and the removed triple's keys are gone
+	if kept != 4 {
+		t.Errorf("Expected the shared triples to keep their 4 keys, got %d", kept)
+	} else if len(versions(styx.Config.Prefixes.Ternary[:]...)) != 9 {
+		t.Errorf("Expected 9 ternary keys, got %d", len(versions(styx.Config.Prefixes.Ternary[:]...)))
+	}
+
+	for _, c := range []struct {
+		p        Permutation
+		a, b     string
+		expected uint32
+	}{
+		{SPO, "s1", "p1", 1},
+		{SPO, "s2", "p1", 1},
+		{POS, "p1", "o2", 2},
+		{POS, "p1", "o1", 0},
+		{OSP, "o1", "s1", 0},
+		{OSP, "o1", "s2", 1},
+	} {
+		key, err := styx.CountKey(c.p, term(c.a), term(c.b))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var count uint32
+		err = styx.Badger.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(key)
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				count = binary.BigEndian.Uint32(val)
+				return nil
+			})
+		})
+		if err != nil {
+			t.Error(err)
+		} else if count != c.expected {
+			t.Errorf("Expected %d for %s %s in permutation %d, got %d", c.expected, c.a, c.b, c.p, count)
+		}
+	}
+
+	// Every binary and unary count matches a recount from the ternary keys
+	expected := counts()
+	err = styx.Refresh()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	actual := counts()
+	if len(actual) != len(expected) {
+		t.Errorf("Expected %d count keys, got %d", len(expected), len(actual))
+	}
+	for key, val := range actual {
+		if expected[key] != val {
+			t.Errorf("Count key %q was %v instead of %v", key, []byte(expected[key]), []byte(val))
+		}
+	}
+}
+
+func TestCanonize(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	// Two structurally identical blank subgraphs, labelled differently in each document
+	documents := []string{`{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/jane",
+	"knows": [
+		{ "@id": "_:a", "name": "Doe" },
+		{ "@id": "_:b", "name": "Doe" }
+	]
+}`, `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/jane",
+	"knows": [
+		{ "@id": "_:y", "name": "Doe" },
+		{ "@id": "_:x", "name": "Doe" }
+	]
+}`}
+
+	datasets := make([]string, len(documents))
+	for i, document := range documents {
+		err := styx.SetJSONLD(d1, document, true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		quads, err := styx.Get(rdf.NewNamedNode(d1))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		lines := make([]string, len(quads))
+		for j, quad := range quads {
+			lines[j] = quad.String()
+		}
+		sort.Strings(lines)
+		datasets[i] = strings.Join(lines, "\n")
+	}
+
+	if datasets[0] != datasets[1] {
+		t.Errorf("Canonized datasets differ:\n%s\n\n%s", datasets[0], datasets[1])
+	}
+
+	if strings.Count(datasets[0], "\n") != 3 {
+		t.Errorf("Expected four quads, got:\n%s", datasets[0])
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	iterator.Timeout(time.Hour)
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(all) != 3 {
+		t.Errorf("Expected 3 results, got %d", len(all))
+		return
+	}
+
+	err = iterator.Seek(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first, err := iterator.Next(nil)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if first == nil {
+		t.Error("Expected a first result")
+		return
+	}
+
+	iterator.Timeout(-time.Second)
+	result, err := iterator.Collect()
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	} else if result == nil || len(result) != 0 {
+		t.Errorf("Expected an empty partial result, got %v", result)
+	}
+
+	if n := iterator.Get(rdf.NewVariable("n")); n == nil || n.Value() != all[0][1].Value() {
+		t.Errorf("Expected the first result to still be bound, got %v", n)
+	}
+
+	_, err = iterator.Next(nil)
+	if err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout after the timeout, got %v", err)
+	}
+}
+
+func TestCollectContext(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	for _, c := range []struct {
+		ctx     context.Context
+		results int
+		partial bool
+		err     error
+	}{
+		{context.Background(), 3, false, nil},
+		{cancelled, 0, false, context.Canceled},
+		{expired, 0, true, nil},
+		// The first solution was found by Query, and the deadline
+		// passes inside the solver while it looks for the second
+		{&countdownContext{Context: context.Background(), remaining: 2, err: context.DeadlineExceeded}, 1, true, nil},
+	} {
+		iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		result, partial, err := iterator.CollectContext(c.ctx)
+		iterator.Close()
+		if err != c.err || partial != c.partial || len(result) != c.results {
+			t.Errorf("Expected %d results, %t, and %v, got %d, %t, and %v", c.results, c.partial, c.err, len(result), partial, err)
+		} else if c.err != nil && result != nil {
+			t.Errorf("Expected no results with an error, got %v", result)
+		}
+	}
+}
+
+func TestCollectShape(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// John has two names, so the second of his results only changes ?n.
+	// Collect still returns every result as a full index in domain order.
+	p, n := rdf.NewVariable("p"), rdf.NewVariable("n")
+	pattern := []*rdf.Quad{rdf.NewQuad(p, rdf.NewNamedNode("http://schema.org/name"), n, rdf.Default)}
+	iterator, err := styx.Query(pattern, []rdf.Term{p, n}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(result) != 3 {
+		t.Errorf("Expected 3 results, got %v", result)
+	}
+
+	for _, index := range result {
+		if len(index) != 2 {
+			t.Errorf("Expected a full index, got %v", index)
+		} else if index[0].TermType() == rdf.LiteralType || index[1].TermType() != rdf.LiteralType {
+			t.Errorf("Expected a person and a name, got %v", index)
+		}
+	}
+}
+
+func TestAsk(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for pattern, expected := range map[string]bool{
+		`?s <http://schema.org/name> ?n .`:                               true,
+		`<http://people.com/jane> <http://schema.org/name> "Jane Doe" .`: true,
+		`<http://people.com/jane> <http://schema.org/name> "John Doe" .`: false,
+		`?s <http://schema.org/name> "Nobody" .`:                         false,
+		`<http://people.com/nobody> <http://schema.org/name> ?n .`:       false,
+		`?s <http://schema.org/knows> ?o .
+?o <http://schema.org/name> "Jane Doe" .`: true,
+	} {
+		quads, err := parsePattern(pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		actual, err := styx.Ask(quads)
+		if err != nil {
+			t.Errorf("%s: %v", pattern, err)
+		} else if actual != expected {
+			t.Errorf("%s: expected %t, got %t", pattern, expected, actual)
+		}
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	results, errors := styx.QueryStream(context.Background(), pattern, nil)
+	names := []string{}
+	for result := range results {
+		names = append(names, result["n"].Value())
+	}
+
+	if err := <-errors; err != nil {
+		t.Error(err)
+	} else if len(names) != 3 {
+		t.Errorf("Expected 3 results, got %v", names)
+	}
+
+	// Cancelling after the first result stops the producer
+	ctx, cancel := context.WithCancel(context.Background())
+	results, errors = styx.QueryStream(ctx, pattern, nil)
+	if result, ok := <-results; !ok || result["n"].Value() != names[0] {
+		t.Errorf("Expected %s first, got %v", names[0], result)
+	}
+
+	cancel()
+	for range results {
+	}
+
+	if err := <-errors; err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestNextAfterExhaustion(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	count := 0
+	for {
+		d, err := iterator.Next(nil)
+		if err != nil {
+			t.Error(err)
+			return
+		} else if d == nil {
+			break
+		}
+		count++
+	}
+
+	if count != 3 {
+		t.Errorf("Expected 3 results, got %d", count)
+	}
+
+	for i := 0; i < 3; i++ {
+		d, err := iterator.Next(nil)
+		if err != nil || d != nil {
+			t.Errorf("Expected nil after exhaustion, got %v, %v", d, err)
+		}
+	}
+}
+
+func TestReverseLookup(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/knows> <http://people.com/jane> .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	// The only constraint seeks the POS index at the predicate and object
+	// instead of scanning every quad with the predicate
+	c := iterator.variables[0].cs[0]
+	if c.prefix[0] != styx.Config.Prefixes.Ternary[POS] || bytes.Count(c.prefix, []byte{'\t'}) != 2 {
+		t.Errorf("Expected a POS prefix with two terms, got %q", c.prefix)
+	}
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 || !strings.HasPrefix(result[0][0].Value(), d1+"#") {
+		t.Errorf("Expected John's blank node, got %v", result)
+	}
+}
+
+func TestResume(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pattern, err := parsePattern(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.Query(pattern, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	all, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(all) != 3 {
+		t.Errorf("Expected 3 results, got %d", len(all))
+		return
+	}
+
+	// Page through the results one at a time, with a new iterator for each page
+	var token []byte
+	for i := range all {
+		if token == nil {
+			iterator, err = styx.Query(pattern, nil, nil)
+		} else {
+			iterator, err = styx.Resume(pattern, token)
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		d, err := iterator.Next(nil)
+		if err != nil {
+			t.Error(err)
+		} else if d == nil {
+			t.Errorf("Expected result %d, got nil", i)
+		} else if index := iterator.Index(); index[1].Value() != all[i][1].Value() {
+			t.Errorf("Expected result %d to be %v, got %v", i, all[i], index)
+		}
+
+		token, err = iterator.Cursor()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	iterator, err = styx.Resume(pattern, token)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	d, err := iterator.Next(nil)
+	iterator.Close()
+	if err != nil || d != nil {
+		t.Errorf("Expected nil after the last page, got %v, %v", d, err)
+	}
+
+	// A token for a different pattern is stale
+	other, err := parsePattern(`?s <http://schema.org/name> ?n .
+?s <http://schema.org/knows> ?o .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = styx.Resume(other, token)
+	if err != ErrStaleCursor {
+		t.Errorf("Expected ErrStaleCursor, got %v", err)
+	}
+
+	// So is one with an IRI that isn't in the database
+	_, err = styx.Resume(pattern, []byte("?s\t<http://people.com/nobody>\n?n\t\"Jane Doe\"\n"))
+	if err != ErrStaleCursor {
+		t.Errorf("Expected ErrStaleCursor for an unknown term, got %v", err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+	styx.Config.SearchMinLength = 5
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Add(rdf.NewNamedNode(d2), rdf.NewQuad(
+		rdf.NewNamedNode("http://people.com/jane"),
+		rdf.NewNamedNode("http://schema.org/description"),
+		rdf.NewLiteral("Jane's a doctor, not a lawyer.", "", nil),
+		rdf.Default,
+	))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for query, expected := range map[string][]string{
+		"doe":           {"Jane Doe", "John Doe", "Johnny Doe"},
+		"JANE":          {"Jane Doe", "Jane's a doctor, not a lawyer."},
+		"jane doe":      {"Jane Doe"},
+		"lawyer":        {"Jane's a doctor, not a lawyer."},
+		"john@":         {"John Doe"},
+		"1996":          {"1996-02-02"},
+		"doctor, john!": {},
+		"":              {},
+	} {
+		result, err := styx.Search(query)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		values := make([]string, len(result))
+		for i, term := range result {
+			values[i] = term.Value()
+		}
+		sort.Strings(values)
+		if strings.Join(values, "|") != strings.Join(expected, "|") {
+			t.Errorf("Search %q: expected %v, got %v", query, expected, values)
+		}
+	}
+
+	// Deleting the last quad of a literal deletes its search keys
+	err = styx.Delete(rdf.NewNamedNode(d2))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := styx.Search("lawyer")
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 0 {
+		t.Errorf("Expected no results after deleting the dataset, got %v", result)
+	}
+
+	err = styx.Badger.View(func(txn *badger.Txn) error {
+		for token, expected := range map[string]bool{"lawyer": false, "doctor": false, "jane": true} {
+			prefix := assembleKey(SearchPrefix, true, ID(token))
+			iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+			iter.Rewind()
+			if iter.Valid() != expected {
+				t.Errorf("Expected search keys for %q: %v", token, expected)
+			}
+			iter.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryOptional(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2, d3: document3} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	pattern, err := parsePattern(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	email, err := parsePattern(`?s <http://schema.org/email> ?e .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	knows, err := parsePattern(`?s <http://schema.org/knows> ?k .
+?k <http://schema.org/name> ?m .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err := styx.QueryOptional(pattern, [][]*rdf.Quad{email, knows}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The domain is ?s ?n ?e ?k ?m
+	expected := map[string]string{
+		"Jane Doe":             "jane@example.com",
+		"John Doe":             "Jane Doe",
+		"Johnny Doe":           "Jane Doe",
+		"Johnanthan Appleseed": "Jane Doe",
+	}
+
+	if len(result) != len(expected) {
+		t.Errorf("Expected %d results, got %v", len(expected), result)
+		return
+	}
+
+	for _, index := range result {
+		if len(index) != 5 || index[0] == nil || index[1] == nil {
+			t.Errorf("Expected ?s and ?n to be bound, got %v", index)
+			continue
+		}
+
+		name := index[1].Value()
+		if name == "Jane Doe" {
+			if index[2] == nil || index[2].Value() != expected[name] || index[3] != nil || index[4] != nil {
+				t.Errorf("Expected only Jane's email to be bound, got %v", index)
+			}
+		} else if index[2] != nil || index[3] == nil || index[4] == nil || index[4].Value() != expected[name] {
+			t.Errorf("Expected %s to know %s and have no email, got %v", name, expected[name], index)
+		}
+	}
+
+	// A block that can't match anything leaves its variables unbound
+	missing, err := parsePattern(`?s <http://schema.org/nothing> ?x .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	result, err = styx.QueryOptional(pattern, [][]*rdf.Quad{missing}, nil)
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != len(expected) {
+		t.Errorf("Expected %d results, got %v", len(expected), result)
+	} else {
+		for _, index := range result {
+			if index[2] != nil {
+				t.Errorf("Expected ?x to be unbound, got %v", index)
+			}
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	a, b := rdf.NewNamedNode("http://example.com/a"), rdf.NewNamedNode("http://example.com/b")
+	name, email := rdf.NewNamedNode("http://schema.org/name"), rdf.NewNamedNode("http://schema.org/email")
+	err := styx.Set(rdf.NewNamedNode(d1), []*rdf.Quad{
+		rdf.NewQuad(a, name, rdf.NewLiteral("Smith, \"Jo\"\nJr.", "", nil), rdf.Default),
+		rdf.NewQuad(a, email, rdf.NewLiteral("jo@example.com", "", nil), rdf.Default),
+		rdf.NewQuad(b, name, rdf.NewLiteral("Kim", "en", rdf.RDFLangString), rdf.Default),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	s, n, e := rdf.NewVariable("s"), rdf.NewVariable("n"), rdf.NewVariable("e")
+	domain := []rdf.Term{s, n, e}
+	result, err := styx.QueryOptional(
+		[]*rdf.Quad{rdf.NewQuad(s, name, n, rdf.Default)},
+		[][]*rdf.Quad{{rdf.NewQuad(s, email, e, rdf.Default)}},
+		domain,
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i][0].Value() < result[j][0].Value() })
+
+	// Kim doesn't have an email, so the last cell of their row is unbound
+	var csv, tsv bytes.Buffer
+	if err = WriteCSV(&csv, domain, result); err != nil {
+		t.Error(err)
+	} else if expected := "s,n,e\r\n" +
+		"http://example.com/a,\"Smith, \"\"Jo\"\"\r\nJr.\",jo@example.com\r\n" +
+		"http://example.com/b,Kim,\r\n"; csv.String() != expected {
+		t.Errorf("Expected CSV %q, got %q", expected, csv.String())
+	}
+
+	if err = WriteTSV(&tsv, domain, result); err != nil {
+		t.Error(err)
+	} else if expected := "?s\t?n\t?e\n" +
+		"<http://example.com/a>\t\"Smith, \\\"Jo\\\"\\nJr.\"\t\"jo@example.com\"\n" +
+		"<http://example.com/b>\t\"Kim\"@en\t\n"; tsv.String() != expected {
+		t.Errorf("Expected TSV %q, got %q", expected, tsv.String())
+	}
+}
+
+func TestFilter(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s, n, b := rdf.NewVariable("s"), rdf.NewVariable("n"), rdf.NewVariable("b")
+	pattern := []*rdf.Quad{
+		rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/name"), n, nil),
+		rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/birthDate"), b, nil),
+	}
+
+	date := func(value string) rdf.Term {
+		return rdf.NewLiteral(value, "", rdf.NewNamedNode(xsdDate))
+	}
+
+	for _, filter := range []struct {
+		node     rdf.Term
+		operator string
+		value    rdf.Term
+		expected []string
+	}{
+		{n, "=", rdf.NewLiteral("Jane Doe", "", nil), []string{"Jane Doe"}},
+		{n, "!=", rdf.NewLiteral("Jane Doe", "", nil), []string{"John Doe", "Johnanthan Appleseed", "Johnny Doe"}},
+		{n, "<", rdf.NewLiteral("John", "", nil), []string{"Jane Doe"}},
+		{n, ">=", rdf.NewLiteral("John Doe", "", nil), []string{"John Doe", "Johnanthan Appleseed", "Johnny Doe"}},
+		{b, ">", date("1995-01-01"), []string{"John Doe", "Johnny Doe"}},
+		{b, "<=", date("1995-01-01"), []string{"Jane Doe", "Johnanthan Appleseed"}},
+		{b, "=", rdf.NewLiteral("1995-01-01T00:00:00Z", "", rdf.NewNamedNode(xsdDateTime)), []string{"Jane Doe"}},
+		{b, "<", rdf.NewLiteral("18", "", rdf.NewNamedNode(ld.XSDInteger)), []string{}},
+		{n, ">", b, []string{}},
+	} {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Filter(filter.node, filter.operator, filter.value)
+		if err != nil {
+			t.Error(err)
+			iterator.Close()
+			continue
+		}
+
+		names := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+			names = append(names, iterator.Get(n).Value())
+		}
+		iterator.Close()
+
+		sort.Strings(names)
+		if strings.Join(names, "|") != strings.Join(filter.expected, "|") {
+			t.Errorf("%s %s %s: expected %v, got %v", filter.node, filter.operator, filter.value, filter.expected, names)
+		}
+	}
+
+	iterator, err := styx.Query(pattern, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	if err := iterator.Filter(n, "~", n); err != ErrInvalidFilter {
+		t.Errorf("Expected ErrInvalidFilter, got %v", err)
+	}
+}
+
+func TestCollectOrdered(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s, n, b := rdf.NewVariable("s"), rdf.NewVariable("n"), rdf.NewVariable("b")
+	pattern := []*rdf.Quad{
+		rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/name"), n, nil),
+		rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/birthDate"), b, nil),
+	}
+
+	for _, order := range []struct {
+		node       rdf.Term
+		descending bool
+		offset     int
+		limit      int
+		expected   []string
+	}{
+		{n, false, 0, 0, []string{"Jane Doe", "John Doe", "Johnanthan Appleseed", "Johnny Doe"}},
+		{n, true, 0, 0, []string{"Johnny Doe", "Johnanthan Appleseed", "John Doe", "Jane Doe"}},
+		{b, false, 0, 2, []string{"Johnanthan Appleseed", "Jane Doe"}},
+		{b, true, 2, 2, []string{"Jane Doe", "Johnanthan Appleseed"}},
+		{n, false, 3, 5, []string{"Johnny Doe"}},
+		{n, false, 4, 1, []string{}},
+	} {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		iterator.Offset(order.offset)
+		iterator.Limit(order.limit)
+		result, err := iterator.CollectOrdered(order.node, order.descending)
+		index := iterator.ids[n.String()]
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		names := make([]string, len(result))
+		for i, terms := range result {
+			names[i] = terms[index].Value()
+		}
+
+		if strings.Join(names, "|") != strings.Join(order.expected, "|") {
+			t.Errorf("Ordering by %s (descending %t, offset %d, limit %d): expected %v, got %v",
+				order.node, order.descending, order.offset, order.limit, order.expected, names)
+		}
+	}
+
+	results := [][]rdf.Term{
+		{nil},
+		{rdf.NewLiteral("10", "", rdf.NewNamedNode(ld.XSDInteger))},
+		{rdf.NewNamedNode("http://example.com/a")},
+		{rdf.NewLiteral("9.5", "", rdf.NewNamedNode(ld.XSDDouble))},
+		{rdf.NewLiteral("a", "", nil)},
+	}
+
+	OrderResults(results, 0, true)
+	values := make([]string, len(results))
+	for i, terms := range results {
+		if terms[0] != nil {
+			values[i] = terms[0].Value()
+		}
+	}
+
+	if strings.Join(values, "|") != "http://example.com/a|a|10|9.5|" {
+		t.Errorf("Unexpected order %v", values)
+	}
+}
+
+func TestQueryDistinct(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	s, n := rdf.NewVariable("s"), rdf.NewVariable("n")
+	pattern := []*rdf.Quad{rdf.NewQuad(s, rdf.NewNamedNode("http://schema.org/name"), n, nil)}
+
+	iterator, err := styx.Query(pattern, []rdf.Term{n}, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	all, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// John has two names, so there are fewer distinct subjects than solutions
+	result, err := styx.QueryDistinct(pattern, []rdf.Term{s})
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(result) != 3 || len(all) != 4 {
+		t.Errorf("Expected 3 distinct subjects out of 4 solutions, got %d out of %d", len(result), len(all))
+	}
+
+	subjects := map[string]bool{}
+	for _, index := range result {
+		if subjects[index[0].String()] {
+			t.Errorf("Duplicate subject %s", index[0])
+		}
+		subjects[index[0].String()] = true
+	}
+
+	// SELECT DISTINCT ?type
+	class := rdf.NewVariable("type")
+	result, err = styx.QueryDistinct([]*rdf.Quad{rdf.NewQuad(s, rdf.NewNamedNode(ld.RDFType), class, nil)}, []rdf.Term{class})
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 1 || result[0][0].Value() != "http://schema.org/Person" {
+		t.Errorf("Expected only schema:Person, got %v", result)
+	}
+}
+
+func TestGraphs(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	// document1 puts the names in a blank graph, and document2 in the default graph
+	for uri, document := range map[string]string{d1: document1, d2: document2} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	dataset, err := getDataset(document3, ld.NewJsonLdOptions(d3))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	graph := rdf.NewNamedNode("http://example.org/sources/people")
+	err = styx.SetGraph(rdf.NewNamedNode(d3), graph, fromLdDataset(dataset, ""))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	names, err := parsePattern(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	emails, err := parsePattern(`?s <http://schema.org/email> ?e .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	count := func(pattern []*rdf.Quad, graphs ...rdf.Term) int {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return -1
+		}
+		defer iterator.Close()
+
+		iterator.Graphs(graphs...)
+		result, err := iterator.Collect()
+		if err != nil {
+			t.Error(err)
+			return -1
+		}
+		return len(result)
+	}
+
+	// Find the skolem IRI of document1's blank graph
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> "Jane Doe" .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = iterator.Next(nil)
+	if err != nil {
+		t.Error(err)
+		iterator.Close()
+		return
+	}
+
+	prov, err := iterator.Prov()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	blank := prov[0][0]
+	if !strings.HasPrefix(blank.Value(), d1+"#") || blank.Value() == d1+"#" {
+		t.Errorf("Expected a blank graph of %s, got %s", d1, blank)
+	}
+
+	for _, c := range []struct {
+		pattern  []*rdf.Quad
+		graphs   []rdf.Term
+		expected int
+	}{
+		{names, nil, 4},
+		{names, []rdf.Term{rdf.Default}, 1},
+		{names, []rdf.Term{rdf.NewNamedNode(d2 + "#")}, 1},
+		{names, []rdf.Term{rdf.NewNamedNode(d1 + "#")}, 0},
+		{names, []rdf.Term{blank}, 3},
+		{names, []rdf.Term{blank, rdf.Default}, 4},
+		{emails, []rdf.Term{graph}, 1},
+		{emails, []rdf.Term{rdf.Default, blank}, 0},
+	} {
+		if actual := count(c.pattern, c.graphs...); actual != c.expected {
+			t.Errorf("Expected %d results in %v, got %d", c.expected, c.graphs, actual)
+		}
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	for uri, document := range map[string]string{d1: document1, d2: document2, d3: document3} {
+		err := styx.SetJSONLD(uri, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	prefixes := styx.Config.Prefixes
+	snapshot := func(db *badger.DB) map[string]string {
+		keys := map[string]string{}
+		db.View(func(txn *badger.Txn) error {
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().KeyCopy(nil)
+				if key[0] == SequenceKey[0] {
+					continue
+				} else if key[0] == prefixes.Ternary[POS] || key[0] == prefixes.Ternary[OSP] {
+					// The values of the minor ternary keys aren't used
+					keys[string(key)] = ""
+				} else {
+					val, err := iter.Item().ValueCopy(nil)
+					if err != nil {
+						t.Error(err)
+					}
+					keys[string(key)] = string(val)
+				}
+			}
+			return nil
+		})
+		return keys
+	}
+
+	expected := snapshot(styx.Badger)
+
+	// Break the source before backing it up
+	err := styx.Badger.Update(func(txn *badger.Txn) error {
+		broken := map[byte]int{prefixes.Unary: 0, prefixes.Binary[PSO]: 0, prefixes.Ternary[POS]: 0}
+		for key := range expected {
+			if n, has := broken[key[0]]; has && n < 2 {
+				broken[key[0]]++
+				if err := txn.Delete([]byte(key)); err != nil {
+					return err
+				}
+			} else if key[0] == prefixes.Binary[SPO] {
+				if err := txn.Set([]byte(key), []byte{0, 0, 0, 9}); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var backup bytes.Buffer
+	err = styx.Backup(&backup)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.RemoveAll(tmpPath + "-restored")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(tmpPath + "-restored"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	dictionary, err := MakeIriDictionary(styx.Config.TagScheme, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	restored, err := NewStore(&Config{
+		TagScheme:  styx.Config.TagScheme,
+		Dictionary: dictionary,
+		QuadStore:  MakeBadgerStore(db),
+	}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer restored.Close()
+
+	err = restored.Restore(&backup)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	actual := snapshot(db)
+	for key, val := range expected {
+		if v, has := actual[key]; !has {
+			t.Errorf("Missing key %q", key)
+		} else if v != val {
+			t.Errorf("Key %q has value %v, expected %v", key, []byte(v), []byte(val))
+		}
+	}
+
+	for key := range actual {
+		if _, has := expected[key]; !has {
+			t.Errorf("Unexpected key %q", key)
+		}
+	}
+
+	// New ids don't collide with the restored ones
+	err = restored.SetJSONLD("http://example.com/d4", `{
+	"@context": { "@vocab": "http://schema.org/" },
+	"@id": "http://people.com/someone",
+	"knows": { "@id": "http://people.com/jane" }
+}`, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := restored.QueryNTriples(`?s <http://schema.org/knows> <http://people.com/jane> .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 3 {
+		t.Errorf("Expected 3 results, got %v", result)
+	}
+}
+
+type recordingMetrics struct {
+	sets    []int
+	queries []QueryStats
+}
+
+func (m *recordingMetrics) ObserveSet(quads int, duration time.Duration) {
+	m.sets = append(m.sets, quads)
+}
+
+func (m *recordingMetrics) ObserveQuery(stats QueryStats) {
+	m.queries = append(m.queries, stats)
+}
+
+func TestMetrics(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	metrics := &recordingMetrics{}
+	styx.Config.Metrics = metrics
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Add(rdf.NewNamedNode(d2), rdf.NewQuad(
+		rdf.NewNamedNode("http://people.com/jane"),
+		rdf.NewNamedNode("http://schema.org/name"),
+		rdf.NewLiteral("Jane", "", nil),
+		rdf.Default,
+	))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(metrics.sets) != 2 || metrics.sets[0] == 0 || metrics.sets[1] != 1 {
+		t.Errorf("Unexpected set observations: %v", metrics.sets)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(metrics.queries) != 0 {
+		t.Error("Expected no query observations before Close")
+		return
+	}
+
+	iterator.Close()
+	iterator.Close()
+
+	if len(metrics.queries) != 1 {
+		t.Errorf("Expected one query observation, got %d", len(metrics.queries))
+		return
+	}
+
+	stats := metrics.queries[0]
+	if stats.Solutions != len(all) {
+		t.Errorf("Expected %d solutions, got %d", len(all), stats.Solutions)
+	} else if stats.Reads == 0 {
+		t.Error("Expected some reads")
+	} else if stats.Duration < stats.Planning {
+		t.Errorf("Expected the duration %v to include the planning time %v", stats.Duration, stats.Planning)
+	}
+}
+
+func TestIteratorString(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	plans := make([]string, 2)
+	for i := range plans {
+		iterator, err := styx.QueryNTriples(`
+?a <http://schema.org/knows> ?b .
+?b <http://schema.org/name> ?n .
+`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = iterator.Next(nil)
+		if err != nil {
+			t.Error(err)
+			iterator.Close()
+			return
+		}
+
+		plans[i] = iterator.String()
+		iterator.Close()
+	}
+
+	if plans[0] != plans[1] {
+		t.Errorf("Expected the same plan twice, got\n%s\n%s", plans[0], plans[1])
+	} else if !strings.Contains(plans[0], " @") {
+		t.Errorf("Expected cursor positions in the plan:\n%s", plans[0])
+	}
+}
+
+func TestDateTimeOrder(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	var warnings bytes.Buffer
+	styx.Config.Logger = log.New(&warnings, "", 0)
+
+	dateTime := func(value string) rdf.Term {
+		return rdf.NewLiteral(value, "", rdf.NewNamedNode(xsdDateTime))
+	}
+
+	at := rdf.NewNamedNode("http://schema.org/startDate")
+	dataset := []*rdf.Quad{}
+	for event, value := range map[string]string{
+		"a": "2020-01-01T00:00:00Z",
+		"b": "2019-12-31T19:00:00-05:00",
+		"c": "2020-01-01T00:00:00.000000001Z",
+		"d": "2019-12-31T23:59:59+00:00",
+		"e": "the first of January",
+	} {
+		dataset = append(dataset, rdf.NewQuad(rdf.NewNamedNode("http://example.com/events/"+event), at, dateTime(value), rdf.Default))
+	}
+
+	err := styx.Set(rdf.NewNamedNode(d1), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	e, v := rdf.NewVariable("e"), rdf.NewVariable("v")
+	pattern := []*rdf.Quad{rdf.NewQuad(e, at, v, rdf.Default)}
+	events := func(iterator *Iterator) []string {
+		names := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+			names = append(names, strings.TrimPrefix(iterator.Get(e).Value(), "http://example.com/events/"))
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, filter := range []struct {
+		operator string
+		value    string
+		expected string
+	}{
+		{"=", "2020-01-01T00:00:00Z", "a b"},
+		{">", "2020-01-01T00:00:00Z", "c"},
+		{"<", "2020-01-01T00:00:00Z", "d"},
+		{"!=", "2020-01-01T00:00:00+00:00", "c d"},
+	} {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Filter(v, filter.operator, dateTime(filter.value))
+		if err != nil {
+			t.Error(err)
+		} else if names := strings.Join(events(iterator), " "); names != filter.expected {
+			t.Errorf("%s %s: expected %q, got %q", filter.operator, filter.value, filter.expected, names)
+		}
+		iterator.Close()
+	}
+
+	iterator, err := styx.Query(pattern, nil, nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	if err = iterator.Filter(v, "<", dateTime("yesterday")); err != ErrInvalidFilter {
+		t.Errorf("Expected ErrInvalidFilter for a malformed value, got %v", err)
+	}
+
+	err = iterator.Range(v, dateTime("2019-12-31T00:00:00Z"), nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if names := strings.Join(events(iterator), " "); names != "a b c d" {
+		t.Errorf("Expected the range to skip the malformed dateTime, got %q", names)
+	} else if !strings.Contains(warnings.String(), "the first of January") {
+		t.Errorf("Expected a warning about the malformed dateTime, got %q", warnings.String())
+	}
+
+	// c is one nanosecond after a and b
+	for _, r := range []struct {
+		min, max rdf.Term
+		expected string
+	}{
+		{nil, dateTime("2020-01-01T00:00:00Z"), "a b d"},
+		{dateTime("2020-01-01T00:00:00.000000001Z"), nil, "c"},
+		{dateTime("2020-01-01T00:00:00Z"), dateTime("2019-12-31T19:00:00-05:00"), "a b"},
+	} {
+		iterator, err := styx.Query(pattern, nil, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = iterator.Range(v, r.min, r.max)
+		if err != nil {
+			t.Error(err)
+		} else if names := strings.Join(events(iterator), " "); names != r.expected {
+			t.Errorf("Range %v to %v: expected %q, got %q", r.min, r.max, r.expected, names)
+		}
+		iterator.Close()
+	}
+
+	results := [][]rdf.Term{}
+	for _, value := range []string{"2020-01-01T00:00:00.000000001Z", "2020-01-01T00:00:00Z", "2019-12-31T23:59:59+00:00"} {
+		results = append(results, []rdf.Term{dateTime(value)})
+	}
+	OrderResults(results, 0, false)
+	if results[0][0].Value() != "2019-12-31T23:59:59+00:00" || results[2][0].Value() != "2020-01-01T00:00:00.000000001Z" {
+		t.Errorf("Unexpected order: %v", results)
+	}
+}
+
+func TestSetRDFDataset(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	dataset, err := ld.ParseNQuads(`<http://people.com/jane> <http://schema.org/name> "Jane Doe" .
+<http://people.com/jane> <http://schema.org/knows> _:b0 .
+_:b0 <http://schema.org/name> "John Doe" <http://example.com/graph> .
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetRDFDataset(rdf.NewNamedNode(d1), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`
+<http://people.com/jane> <http://schema.org/knows> ?b .
+?b <http://schema.org/name> ?n .
+`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(all) != 1 || all[0][1].Value() != "John Doe" {
+		t.Errorf("Unexpected results: %v", all)
+	}
+
+	if err = styx.SetRDFDataset(rdf.NewNamedNode(d2), nil); err != ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for a nil dataset, got %v", err)
+	}
+}
+
+func TestSetNQuads(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var before bytes.Buffer
+	err = styx.Dump(&before)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.SetNQuads(rdf.NewNamedNode(d1), bytes.NewReader(before.Bytes()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var after bytes.Buffer
+	err = styx.Dump(&after)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if before.String() != after.String() {
+		t.Errorf("Expected the dump to round-trip:\n%s\n%s", before.String(), after.String())
+	}
+
+	err = styx.SetNQuads(rdf.NewNamedNode(d2), strings.NewReader("<http://people.com/jane> .\n"))
+	if err == nil {
+		t.Error("Expected an error for invalid N-Quads")
+	}
+}
+
+func TestQuerySPARQL(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for query, expected := range map[string][]string{
+		`SELECT ?n WHERE { ?s <http://schema.org/name> ?n }`: {
+			"Jane Doe", "John Doe", "Johnny Doe",
+		},
+		`PREFIX schema: <http://schema.org/>
+		# Everyone that John knows
+		SELECT ?n WHERE {
+			?s schema:name "John Doe" ; schema:knows _:b .
+			_:b schema:name ?n .
+		}`: {"Jane Doe"},
+	} {
+		iterator, err := styx.QuerySPARQL(query)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		names := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+			names = append(names, iterator.Get(rdf.NewVariable("n")).Value())
+		}
+		iterator.Close()
+		sort.Strings(names)
+		if strings.Join(names, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("%s: expected %v, got %v", query, expected, names)
+		}
+	}
+
+	iterator, err := styx.QuerySPARQL(`PREFIX schema: <http://schema.org/> SELECT * { ?s schema:name ?n } LIMIT 5 OFFSET 1`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	all, err := iterator.Collect()
+	iterator.Close()
+	if err != nil {
+		t.Error(err)
+	} else if len(all) != 2 {
+		t.Errorf("Expected 2 results after the offset, got %d", len(all))
+	}
+
+	plan, err := ParseSPARQL(`SELECT ?s ?n { ?s a <http://schema.org/Person> ; <http://schema.org/age> 18, 1.5, "x"@en, "y"^^<http://example.com/t> . }`)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if len(plan.Domain) != 2 || len(plan.Pattern) != 5 {
+		t.Errorf("Unexpected plan: %v %v", plan.Domain, plan.Pattern)
+	} else if plan.Pattern[0][1].Value() != ld.RDFType || plan.Pattern[3][2].(*rdf.Literal).Language() != "en" {
+		t.Errorf("Unexpected pattern: %v", plan.Pattern)
+	}
+
+	for _, query := range []string{
+		`SELECT WHERE { ?s ?p ?o }`,
+		`SELECT ?s WHERE { ?s ex:name ?o }`,
+		`SELECT ?s WHERE { ?s <http://schema.org/name> }`,
+		`SELECT ?s WHERE { ?s <http://schema.org/name> ?o } LIMIT ten`,
+		`SELECT ?s WHERE { ?s <http://schema.org/name> ?o . FILTER(?o > 1) }`,
+	} {
+		if _, err := ParseSPARQL(query); err == nil {
+			t.Errorf("Expected an error parsing %s", query)
+		}
+	}
+}
+
+func TestEmptyResults(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, pattern := range []string{
+		// An IRI that isn't in the database
+		`?s <http://schema.org/nickname> ?n .`,
+		// Terms that are in the database but never together
+		`<http://people.com/jane> <http://schema.org/knows> ?o .`,
+		`?s <http://schema.org/name> ?n .
+?n <http://schema.org/unknown> <http://people.com/nobody> .`,
+	} {
+		iterator, err := styx.QueryNTriples(pattern)
+		if err != nil {
+			t.Errorf("Expected no error for %s, got %v", pattern, err)
+			continue
+		}
+
+		all, err := iterator.Collect()
+		iterator.Close()
+		if err != nil {
+			t.Error(err)
+		} else if len(all) != 0 {
+			t.Errorf("Expected no results for %s, got %v", pattern, all)
+		}
+	}
+
+	_, err = styx.QueryNTriples(`?s <http://schema.org/name> .`)
+	if err == nil {
+		t.Error("Expected an error for an invalid pattern")
+	}
+
+	// An invalid query is still an error when a constant is missing
+	s, missing := rdf.NewVariable("s"), rdf.NewNamedNode("http://schema.org/nickname")
+	for _, invalid := range []struct {
+		quad     *rdf.Quad
+		domain   []rdf.Term
+		expected error
+	}{
+		{rdf.NewQuad(s, missing, rdf.NewBlankNode("a#b"), rdf.Default), nil, ErrInvalidLabel},
+		{rdf.NewQuad(s, rdf.NewVariable("p"), s, rdf.Default), nil, ErrUnboundTriple},
+		{rdf.NewQuad(s, missing, rdf.NewVariable("n"), rdf.Default), []rdf.Term{rdf.NewVariable("x")}, ErrInvalidDomain},
+	} {
+		pattern := []*rdf.Quad{rdf.NewQuad(s, missing, rdf.NewVariable("n"), rdf.Default), invalid.quad}
+		_, err = styx.Query(pattern, invalid.domain, nil)
+		if err != invalid.expected {
+			t.Errorf("Expected %v for %s, got %v", invalid.expected, invalid.quad, err)
+		}
+	}
+}
+
+func TestConcurrentSet(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	counts := func() map[string]string {
+		result := map[string]string{}
+		err := styx.Badger.View(func(txn *badger.Txn) error {
+			prefixes := styx.Config.Prefixes
+			iter := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer iter.Close()
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				key := iter.Item().KeyCopy(nil)
+				if key[0] == prefixes.Unary || bytes.IndexByte(prefixes.Binary[:], key[0]) != -1 {
+					val, err := iter.Item().ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					result[string(key)] = string(val)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return result
+	}
+
+	knows, name := rdf.NewNamedNode("http://schema.org/knows"), rdf.NewNamedNode("http://schema.org/name")
+	jane := rdf.NewNamedNode("http://people.com/jane")
+
+	const writers = 8
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			person := rdf.NewNamedNode(fmt.Sprintf("http://people.com/%d", i))
+			errs <- styx.Set(rdf.NewNamedNode(fmt.Sprintf("http://example.com/c/%d", i)), []*rdf.Quad{
+				rdf.NewQuad(person, knows, jane, rdf.Default),
+				rdf.NewQuad(person, name, rdf.NewLiteral(fmt.Sprintf("Person %d", i), "", nil), rdf.Default),
+				rdf.NewQuad(jane, name, rdf.NewLiteral("Jane Doe", "", nil), rdf.Default),
+				rdf.NewQuad(jane, knows, person, rdf.Default),
+			})
+		}(i)
+	}
+
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	before := counts()
+
+	err := styx.Refresh()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	after := counts()
+	if len(before) != len(after) {
+		t.Errorf("Expected %d count keys, got %d", len(after), len(before))
+	}
+	for key, val := range after {
+		if before[key] != val {
+			t.Errorf("Count key %q was %v instead of %v", key, []byte(before[key]), []byte(val))
+		}
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/knows> <http://people.com/jane> .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	all, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(all) != writers {
+		t.Errorf("Expected %d people to know jane, got %d", writers, len(all))
+	}
+}
+
+func TestCyclicPatterns(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	knows := rdf.NewNamedNode("http://schema.org/knows")
+	person := func(name string) rdf.Term { return rdf.NewNamedNode("http://people.com/" + name) }
+
+	dataset := []*rdf.Quad{}
+	for _, edge := range [][2]string{{"a", "b"}, {"b", "c"}, {"c", "a"}, {"a", "d"}, {"d", "a"}, {"c", "d"}} {
+		dataset = append(dataset, rdf.NewQuad(person(edge[0]), knows, person(edge[1]), rdf.Default))
+	}
+
+	err := styx.Set(rdf.NewNamedNode(d1), dataset)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for pattern, expected := range map[string][]string{
+		`?x <http://schema.org/knows> ?y .
+?y <http://schema.org/knows> ?x .`: {"a d", "d a"},
+		`?x <http://schema.org/knows> ?y .
+?y <http://schema.org/knows> ?z .
+?z <http://schema.org/knows> ?x .`: {"a b c", "b c a", "c a b"},
+		`?x <http://schema.org/knows> ?y .
+?y <http://schema.org/knows> ?z .
+?z <http://schema.org/knows> ?w .
+?w <http://schema.org/knows> ?x .`: {"a b c d", "a d a d", "b c d a", "c d a b", "d a b c", "d a d a"},
+	} {
+		iterator, err := styx.QueryNTriples(pattern)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		x, y, z, w := rdf.NewVariable("x"), rdf.NewVariable("y"), rdf.NewVariable("z"), rdf.NewVariable("w")
+		results := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+
+			names := []string{}
+			for _, node := range []rdf.Term{x, y, z, w} {
+				if term := iterator.Get(node); term != nil {
+					names = append(names, strings.TrimPrefix(term.Value(), "http://people.com/"))
+				}
+			}
+			results = append(results, strings.Join(names, " "))
+		}
+		iterator.Close()
+
+		sort.Strings(results)
+		if strings.Join(results, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("Expected %v, got %v", expected, results)
+		}
+	}
+}
+
+func TestPrefixSchema(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = NewStore(&Config{}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	prefixes := DefaultPrefixes
+	prefixes.Binary[0] = 'I'
+	_, err = NewStore(&Config{Prefixes: &prefixes}, db)
+	if err != ErrPrefixMismatch {
+		t.Errorf("Expected ErrPrefixMismatch for moved indices, got %v", err)
+	}
+
+	// A namespace that shares some of the default namespace's bytes
+	prefixes = DefaultPrefixes
+	prefixes.Ternary = [3]byte{'A', 'B', 'C'}
+	_, err = NewStore(&Config{Prefixes: &prefixes}, db)
+	if err != ErrPrefixCollision {
+		t.Errorf("Expected ErrPrefixCollision for overlapping namespaces, got %v", err)
+	}
+
+	defer func() {
+		registry.Lock()
+		delete(registry.families, "test/range")
+		registry.Unlock()
+	}()
+
+	for _, registration := range []struct {
+		name     string
+		prefix   byte
+		expected error
+	}{
+		{"test/range", 'r', nil},
+		{"test/range", 'r', nil},
+		{"test/range", 's', ErrPrefixCollision},
+		{"test/other", 'r', ErrPrefixCollision},
+		{"test/other", TernaryPrefixes[0], ErrPrefixCollision},
+		{"test/other", SchemaKey[0], ErrPrefixCollision},
+	} {
+		if err := RegisterPrefix(registration.name, registration.prefix); err != registration.expected {
+			t.Errorf("Registering %s at %c: expected %v, got %v", registration.name, registration.prefix, registration.expected, err)
+		}
+	}
+
+	_, err = NewStore(&Config{Reserved: []byte{'r'}}, db)
+	if err != ErrPrefixCollision {
+		t.Errorf("Expected ErrPrefixCollision for a reserved registered prefix, got %v", err)
+	}
+
+	_, err = NewStore(&Config{}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(SchemaKey, TernaryPrefixes[SPO]))
+		if err != nil {
+			return err
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		schema, hash, err := parseSchema(val)
+		if err != nil {
+			return err
+		} else if schema["test/range"] != 'r' || schema["ternary/0"] != TernaryPrefixes[0] {
+			t.Errorf("Unexpected schema: %s", val)
+		} else if hash != fingerprint(SHA256) {
+			t.Errorf("Unexpected schema: %s", val)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	styx := open()
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Databases written before the schema key existed don't have one
+	err = styx.Badger.DropPrefix(SchemaKey)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = styx.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(tmpPath).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tags := NewPrefixTagScheme("http://example.com/")
+	dictionary, err := MakeIriDictionary(tags, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	styx, err = NewStore(&Config{TagScheme: tags, Dictionary: dictionary, QuadStore: MakeBadgerStore(db)}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	iterator, err := styx.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer iterator.Close()
+
+	result, err := iterator.Collect()
+	if err != nil {
+		t.Error(err)
+	} else if len(result) != 3 {
+		t.Errorf("Expected 3 results from the read-only store, got %d", len(result))
+	}
+}
+
+func TestHas(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	err := styx.SetJSONLD(d1, document1, false)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	jane, name := rdf.NewNamedNode("http://people.com/jane"), rdf.NewNamedNode("http://schema.org/name")
+	quad := rdf.NewQuad(jane, name, rdf.NewLiteral("Jane Doe", "", nil), rdf.Default)
+	for _, test := range []struct {
+		quad     *rdf.Quad
+		expected bool
+	}{
+		{quad, true},
+		{rdf.NewQuad(jane, name, rdf.NewLiteral("Jane Doe", "", nil), rdf.NewNamedNode("http://example.com/graph")), true},
+		{rdf.NewQuad(jane, name, rdf.NewLiteral("John Doe", "", nil), rdf.Default), false},
+		{rdf.NewQuad(jane, rdf.NewNamedNode("http://schema.org/nickname"), rdf.NewLiteral("Jane Doe", "", nil), rdf.Default), false},
+	} {
+		has, err := styx.Has(test.quad)
+		if err != nil {
+			t.Error(err)
+		} else if has != test.expected {
+			t.Errorf("Expected Has(%s) to be %t", test.quad.String(), test.expected)
+		}
+	}
+
+	_, err = styx.Has(rdf.NewQuad(jane, name, rdf.NewVariable("n"), rdf.Default))
+	if err != ErrInvalidInput {
+		t.Errorf("Expected ErrInvalidInput for a variable, got %v", err)
+	}
+
+	err = styx.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	has, err := styx.Has(quad)
+	if err != nil {
+		t.Error(err)
+	} else if has {
+		t.Error("Expected the quad to be gone after deleting its dataset")
+	}
+}
+
+func TestStats(t *testing.T) {
+	styx := open()
+	defer styx.Close()
+
+	term := func(name string) rdf.Term { return rdf.NewNamedNode("http://example.com/" + name) }
+	dataset := []*rdf.Quad{
+		rdf.NewQuad(term("s1"), term("p1"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p1"), term("o2"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p1"), term("o1"), rdf.Default),
+		rdf.NewQuad(term("s2"), term("p2"), term("s1"), rdf.Default),
+		rdf.NewQuad(term("s1"), term("p2"), rdf.NewLiteral("s1", "", nil), rdf.Default),
+	}
+
+	// The triples that both datasets assert only count once
+	for uri, quads := range map[string][]*rdf.Quad{d1: dataset, d2: dataset[:3]} {
+		err := styx.Set(rdf.NewNamedNode(uri), quads)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	stats, err := styx.Stats(1)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if stats.Triples != 5 || stats.Subjects != 2 || stats.Predicates != 2 || stats.Objects != 4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	} else if len(stats.Top) != 1 || !stats.Top[0].Predicate.Equal(term("p1")) || stats.Top[0].Triples != 3 {
+		t.Errorf("Unexpected top predicates: %+v", stats.Top)
+	}
+
+	stats, err = styx.Stats(-1)
+	if err != nil {
+		t.Error(err)
+	} else if len(stats.Top) != 2 || stats.Top[1].Triples != 2 {
+		t.Errorf("Unexpected top predicates: %+v", stats.Top)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Both stores are given the same quad store
+	tags, quads := NewPrefixTagScheme("http://example.com/"), MakeBadgerStore(db)
+	a, err := NewStore(&Config{TagScheme: tags, QuadStore: quads}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := NewStore(&Config{
+		TagScheme: tags,
+		QuadStore: quads,
+		Prefixes: &Prefixes{
+			Ternary:  [3]byte{'A', 'B', 'C'},
+			Binary:   [6]byte{'I', 'J', 'K', 'L', 'M', 'N'},
+			Unary:    'U',
+			Dataset:  ';',
+			Metadata: '!',
+			Search:   '=',
+			Range:    '|',
+		},
+		SearchMinLength: 1,
+	}, db)
+	if err != nil {
+		t.Error(err)
+		return
+	} else if a.Config.QuadStore != quads || b.Config.QuadStore == quads {
+		t.Error("Expected the second store to get its own copy of the quad store")
+	}
+
+	for store, document := range map[*Store]string{a: document1, b: document2} {
+		err = store.SetJSONLD(d1, document, false)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	err = b.SetMetadata(rdf.NewNamedNode(d1), []byte("b"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for store, expected := range map[*Store][]string{a: {"Jane Doe", "John Doe", "Johnny Doe"}, b: {"Johnanthan Appleseed"}} {
+		iterator, err := store.QueryNTriples(`?s <http://schema.org/name> ?n .`)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		names := []string{}
+		for {
+			d, err := iterator.Next(nil)
+			if err != nil {
+				t.Error(err)
+				break
+			} else if d == nil {
+				break
+			}
+			names = append(names, iterator.Get(rdf.NewVariable("n")).Value())
+		}
+		iterator.Close()
+
+		sort.Strings(names)
+		if strings.Join(names, ", ") != strings.Join(expected, ", ") {
+			t.Errorf("Expected %v, got %v", expected, names)
+		}
+
+		stats, err := store.Stats(0)
+		if err != nil {
+			t.Error(err)
+		} else if dataset, err := store.Get(rdf.NewNamedNode(d1)); err != nil {
+			t.Error(err)
+		} else if uint64(len(dataset)) != stats.Triples {
+			t.Errorf("Expected the dataset's %d quads to be all of the namespace's triples, got %d", len(dataset), stats.Triples)
+		}
+	}
+
+	if terms, err := b.Search("Appleseed"); err != nil {
+		t.Error(err)
+	} else if len(terms) != 1 {
+		t.Errorf("Expected one search result, got %v", terms)
+	}
+
+	// The second store's search keys are in its own namespace
+	err = db.View(func(txn *badger.Txn) error {
+		for prefix, expected := range map[byte]bool{SearchPrefix: false, '=': true} {
+			iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: []byte{prefix}})
+			iter.Rewind()
+			if iter.Valid() != expected {
+				t.Errorf("Expected search keys under %c: %v", prefix, expected)
+			}
+			iter.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if _, err = a.GetMetadata(rdf.NewNamedNode(d1)); err != ErrNotFound {
+		t.Errorf("Expected no metadata in the default namespace, got %v", err)
+	}
+
+	err = a.Delete(rdf.NewNamedNode(d1))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if metadata, err := b.GetMetadata(rdf.NewNamedNode(d1)); err != nil || string(metadata) != "b" {
+		t.Errorf("Expected deleting from one namespace to leave the other, got %q %v", metadata, err)
+	}
+}
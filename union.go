@@ -0,0 +1,91 @@
+package styx
+
+import (
+	"strings"
+
+	rdf "github.com/underlay/go-rdfjs"
+)
+
+// QueryUnion solves each of the patterns independently and returns the distinct
+// solutions of all of them, projected onto the given domain.
+// Variables of the domain that a pattern doesn't use are unbound (nil) in its
+// solutions, like the variables of an unmatched block in QueryOptional;
+// QueryUnion returns ErrInvalidDomain if no pattern uses one of them.
+// If domain is nil, the variables of all the patterns are used, in order.
+// Solutions are returned in the order they're found: pattern by pattern,
+// with later duplicates dropped.
+func (s *Store) QueryUnion(patterns [][]*rdf.Quad, domain []rdf.Term) ([][]rdf.Term, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	variables := make([]map[string]bool, len(patterns))
+	for i, pattern := range patterns {
+		variables[i] = make(map[string]bool)
+		for _, node := range getVariables(pattern) {
+			variables[i][node.String()] = true
+		}
+	}
+
+	if domain == nil {
+		domain = []rdf.Term{}
+		seen := map[string]bool{}
+		for _, pattern := range patterns {
+			for _, node := range getVariables(pattern) {
+				if !seen[node.String()] {
+					seen[node.String()] = true
+					domain = append(domain, node)
+				}
+			}
+		}
+	}
+
+	for _, node := range domain {
+		used := false
+		for _, vars := range variables {
+			used = used || vars[node.String()]
+		}
+		if !used {
+			return nil, ErrInvalidDomain
+		}
+	}
+
+	result := [][]rdf.Term{}
+	solutions := make(map[string]bool)
+	for i, pattern := range patterns {
+		bound := []rdf.Term{}
+		for _, node := range domain {
+			if variables[i][node.String()] {
+				bound = append(bound, node)
+			}
+		}
+
+		iter, err := s.Query(pattern, bound, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		index, err := iter.project(domain)
+		iter.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, terms := range index {
+			values := make([]string, len(terms))
+			for j, term := range terms {
+				if term != nil {
+					values[j] = term.String()
+				}
+			}
+
+			key := strings.Join(values, "\n")
+			if !solutions[key] {
+				solutions[key] = true
+				result = append(result, terms)
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"regexp"
+	"sort"
 	"strings"
 
 	badger "github.com/dgraph-io/badger/v2"
@@ -191,6 +193,47 @@ func fromLdDataset(dataset *ld.RDFDataset, base string) []*rdf.Quad {
 	return result
 }
 
+func fromLdDatasetQuads(dataset *ld.RDFDataset) []*ld.Quad {
+	result := []*ld.Quad{}
+	for _, quads := range dataset.Graphs {
+		result = append(result, quads...)
+	}
+	return result
+}
+
+func fromLdQuads(quads []*ld.Quad) []*rdf.Quad {
+	result := make([]*rdf.Quad, len(quads))
+	for i, quad := range quads {
+		result[i] = fromLdQuad(quad, "")
+	}
+	return result
+}
+
+// serializeLdQuads returns the sorted N-Quads lines of the quads
+func serializeLdQuads(quads []*ld.Quad) ([]string, error) {
+	dataset := ld.NewRDFDataset()
+	for _, quad := range quads {
+		graph := "@default"
+		if quad.Graph != nil {
+			graph = quad.Graph.GetValue()
+		}
+		dataset.Graphs[graph] = append(dataset.Graphs[graph], quad)
+	}
+
+	serializer := &ld.NQuadRDFSerializer{}
+	result, err := serializer.Serialize(dataset)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(result.(string)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		lines = []string{}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
 func fromLdQuad(quad *ld.Quad, base string) *rdf.Quad {
 	return rdf.NewQuad(
 		fromLdNode(quad.Subject, base),
@@ -200,6 +243,62 @@ func fromLdQuad(quad *ld.Quad, base string) *rdf.Quad {
 	)
 }
 
+// parsePattern parses N-Triples lines that may contain variables into quads
+func parsePattern(pattern string) ([]*rdf.Quad, error) {
+	quads := []*rdf.Quad{}
+	for i, line := range strings.Split(pattern, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		quad := rdf.ParseQuad(line)
+		if quad == nil {
+			return nil, fmt.Errorf("Invalid triple on line %d: %s", i+1, line)
+		}
+		quads = append(quads, quad)
+	}
+	return quads, nil
+}
+
+// isVariable checks whether a term of a pattern is a variable or a blank node
+func isVariable(term rdf.Term) bool {
+	return term.TermType() == rdf.VariableType || term.TermType() == rdf.BlankNodeType
+}
+
+// getVariables returns the distinct variables of a pattern in order of appearance
+func getVariables(pattern []*rdf.Quad) []rdf.Term {
+	variables := []rdf.Term{}
+	values := map[string]bool{}
+	for _, quad := range pattern {
+		for _, term := range quad {
+			if term != nil && term.TermType() == rdf.VariableType && !values[term.String()] {
+				values[term.String()] = true
+				variables = append(variables, term)
+			}
+		}
+	}
+	return variables
+}
+
+// bindBlankNodes replaces the blank nodes of a pattern whose labels
+// start with prefix with variables named by the rest of their labels
+func bindBlankNodes(pattern []*rdf.Quad, prefix string) []*rdf.Quad {
+	result := make([]*rdf.Quad, len(pattern))
+	for i, quad := range pattern {
+		terms := [4]rdf.Term{}
+		for j, term := range quad {
+			if term != nil && term.TermType() == rdf.BlankNodeType && strings.HasPrefix(term.Value(), prefix) {
+				terms[j] = rdf.NewVariable(term.Value()[len(prefix):])
+			} else {
+				terms[j] = term
+			}
+		}
+		result[i] = rdf.NewQuad(terms[0], terms[1], terms[2], terms[3])
+	}
+	return result
+}
+
 var blankNodePrefix = "_:"
 
 func fromLdNode(node ld.Node, base string) rdf.Term {
@@ -3,6 +3,7 @@ package styx
 import (
 	"fmt"
 	"sort"
+	"time"
 
 	rdf "github.com/underlay/go-rdfjs"
 )
@@ -15,7 +16,55 @@ type variable struct {
 	value ID            // Tha val
 	root  ID            // the first possible value for the variable, without joining on other variables
 	norm  uint64        // The sum of squares of key counts of constraints
-	score float64       // norm / size
+	score float64       // The ScoreFunction of the counts
+
+	analyze  bool          // Whether to record advances and elapsed time
+	advances int           // The number of calls to Seek and Next
+	elapsed  time.Duration // The total time spent in Seek and Next
+}
+
+// A ScoreFunction estimates the cost of solving a variable first
+// from the counts of its constraints
+type ScoreFunction func(counts []uint32) float64
+
+// NormScore is the length-normalized sum of the squares of the counts.
+// A variable without any constraints scores 0.
+func NormScore(counts []uint32) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+
+	var norm uint64
+	for _, count := range counts {
+		norm += uint64(count) * uint64(count)
+	}
+	return float64(norm) / float64(len(counts))
+}
+
+// SelectivityScore estimates the number of values the variable will take.
+// The intersection of its constraints is at most the smallest count,
+// and every other constraint is assumed to keep the fraction of it
+// that the smallest count is of its own count.
+// A variable without any constraints scores 0.
+func SelectivityScore(counts []uint32) float64 {
+	if len(counts) == 0 {
+		return 0
+	}
+
+	min := counts[0]
+	for _, count := range counts[1:] {
+		if count < min {
+			min = count
+		}
+	}
+
+	estimate := float64(min)
+	for _, count := range counts {
+		if count > 0 {
+			estimate *= float64(min) / float64(count)
+		}
+	}
+	return estimate
 }
 
 func (u *variable) ID() ID {
@@ -29,12 +78,9 @@ func (u *variable) String() (s string) {
 	if u.root != NIL {
 		s += fmt.Sprintf("Root: %s\n", u.root)
 	}
-	// s += fmt.Sprintf("DZ: %s\n", u.DZ.String())
-	// s += fmt.Sprintf("D1: %s\n", u.D1.String())
+	s += fmt.Sprintf("Constraints: %s\n", u.cs.String())
 	s += fmt.Sprintln("D2:")
-	for id, cs := range u.edges {
-		s += fmt.Sprintf("  %d: %s\n", id, cs.String())
-	}
+	s += u.edges.String()
 	s += fmt.Sprintf("Norm: %d\n", u.norm)
 	s += fmt.Sprintf("Size: %d\n", u.cs.Len())
 	s += fmt.Sprintf("Score: %f\n", u.score)
@@ -55,12 +101,28 @@ func (u *variable) Sort() {
 
 // Seek to the next intersect value
 func (u *variable) Seek(value ID) ID {
-	return u.cs.Seek(value)
+	if !u.analyze {
+		return u.cs.Seek(value)
+	}
+
+	start := time.Now()
+	value = u.cs.Seek(value)
+	u.advances++
+	u.elapsed += time.Since(start)
+	return value
 }
 
 // Next returns the next intersect value
 func (u *variable) Next() ID {
-	return u.cs.Next()
+	if !u.analyze {
+		return u.cs.Next()
+	}
+
+	start := time.Now()
+	value := u.cs.Next()
+	u.advances++
+	u.elapsed += time.Since(start)
+	return value
 }
 
 // caches is a slice of C structs
@@ -86,6 +148,13 @@ func (g *Iterator) load(u *variable, vc *vcache) {
 	u.value = vc.ID
 	for _, d := range vc.caches {
 		c := u.edges[d.i][d.j]
+		if c.unbound {
+			// The prefix of a third-degree constraint is pushed from the
+			// variables before it, so only its cursor has to be restored
+			c.count = d.c
+			c.Seek(u.value)
+			continue
+		}
 
 		v := g.variables[d.i]
 		m, n := (c.place+1)%3, (c.place+2)%3
@@ -98,9 +167,9 @@ func (g *Iterator) load(u *variable, vc *vcache) {
 		}
 
 		if c.terms[other] == NIL {
-			c.prefix = assembleKey(BinaryPrefixes[p], true, vc.ID)
+			c.prefix = assembleKey(g.prefixes.Binary[p], true, vc.ID)
 		} else {
-			c.prefix = assembleKey(TernaryPrefixes[m], true, c.terms[m], c.terms[n])
+			c.prefix = assembleKey(g.prefixes.Ternary[m], true, c.terms[m], c.terms[n])
 		}
 
 		c.count = d.c
@@ -0,0 +1,215 @@
+package styx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v2"
+)
+
+// A Verifier checks the count keys against the index in the background,
+// one key at a time, so that drift (e.g. from an interrupted write) is found
+// without a full Refresh. It reads one count key per interval and keeps
+// walking through all of them, starting over when it reaches the end.
+type Verifier struct {
+	store        *Store
+	interval     time.Duration
+	repair       bool
+	stop         chan struct{}
+	once         sync.Once
+	wg           sync.WaitGroup
+	prefix       int
+	cursor       []byte
+	checked      int64
+	inconsistent int64
+	passes       int64
+}
+
+// VerifierStats is a snapshot of a Verifier's progress
+type VerifierStats struct {
+	Checked      int64 // The number of count keys read
+	Inconsistent int64 // The number of count keys that didn't match the index
+	Passes       int64 // The number of completed passes over all of the count keys
+}
+
+// StartVerifier starts a Verifier that checks one count key every interval.
+// Inconsistent keys are reported to Config.Logger if it's set, and if repair is true
+// the Verifier rewrites each one with the count it should have (or deletes it
+// if it doesn't count anything), like Refresh does for all of them.
+// Errors (like transaction conflicts with concurrent writes) are logged and the key
+// is tried again on the next interval. The Verifier has to be stopped with Stop
+// before the store is closed, since it keeps reading from the database until then.
+// The interval has to be positive, otherwise StartVerifier returns ErrInvalidInterval.
+func (s *Store) StartVerifier(interval time.Duration, repair bool) (*Verifier, error) {
+	if interval <= 0 {
+		return nil, ErrInvalidInterval
+	}
+
+	v := &Verifier{store: s, interval: interval, repair: repair, stop: make(chan struct{})}
+	v.wg.Add(1)
+	go v.run()
+	return v, nil
+}
+
+// Stop the verifier and wait for it to finish the key it's checking
+func (v *Verifier) Stop() {
+	v.once.Do(func() { close(v.stop) })
+	v.wg.Wait()
+}
+
+// Stats returns the verifier's progress so far
+func (v *Verifier) Stats() VerifierStats {
+	return VerifierStats{
+		Checked:      atomic.LoadInt64(&v.checked),
+		Inconsistent: atomic.LoadInt64(&v.inconsistent),
+		Passes:       atomic.LoadInt64(&v.passes),
+	}
+}
+
+func (v *Verifier) run() {
+	defer v.wg.Done()
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-v.stop:
+			return
+		case <-ticker.C:
+			err := v.step()
+			if err != nil && v.store.Config.Logger != nil {
+				v.store.Config.Logger.Printf("styx: verifier: %v", err)
+			}
+		}
+	}
+}
+
+// step checks the count key after the cursor
+func (v *Verifier) step() error {
+	prefixes := v.store.Config.Prefixes
+	counts := append([]byte{prefixes.Unary}, prefixes.Binary[:]...)
+
+	txn := v.store.Badger.NewTransaction(false)
+	defer txn.Discard()
+
+	for i := 0; i <= len(counts); i++ {
+		prefix := []byte{counts[v.prefix]}
+		iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+		if v.cursor == nil {
+			iter.Seek(prefix)
+		} else {
+			iter.Seek(v.cursor)
+			if iter.Valid() && string(iter.Item().Key()) == string(v.cursor) {
+				iter.Next()
+			}
+		}
+
+		if !iter.Valid() {
+			iter.Close()
+			v.prefix, v.cursor = (v.prefix+1)%len(counts), nil
+			if v.prefix == 0 {
+				atomic.AddInt64(&v.passes, 1)
+			}
+			continue
+		}
+
+		item := iter.Item()
+		key := item.KeyCopy(nil)
+		val, err := item.ValueCopy(nil)
+		iter.Close()
+		if err != nil {
+			return err
+		}
+
+		v.cursor = key
+		atomic.AddInt64(&v.checked, 1)
+		if verifyCount(key, val, prefixes, txn) {
+			return nil
+		}
+
+		atomic.AddInt64(&v.inconsistent, 1)
+		if v.store.Config.Logger != nil {
+			v.store.Config.Logger.Printf("styx: verifier: inconsistent count key %q", key)
+		}
+
+		if v.repair {
+			return v.repairCount(key)
+		}
+		return nil
+	}
+
+	return nil
+}
+
+// repairCount rewrites a single count key with the value that the index implies,
+// holding the store's write lock so that no write changes the index in between
+func (v *Verifier) repairCount(key []byte) error {
+	s := v.store
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Badger.Update(func(txn *badger.Txn) error {
+		val, ok := expectedCount(key, s.Config.Prefixes, txn)
+		if !ok || bytes.Equal(val, make([]byte, len(val))) {
+			return txn.Delete(key)
+		}
+		return txn.Set(key, val)
+	})
+}
+
+// verifyCount checks that a unary or binary count key's value matches
+// the number of binary or ternary keys that it counts
+func verifyCount(key, val []byte, prefixes *Prefixes, txn *badger.Txn) bool {
+	expected, ok := expectedCount(key, prefixes, txn)
+	return ok && bytes.Equal(val, expected)
+}
+
+// expectedCount returns the value that a unary or binary count key should have,
+// or false if the key isn't shaped like one
+func expectedCount(key []byte, prefixes *Prefixes, txn *badger.Txn) ([]byte, bool) {
+	ids := strings.Split(string(key[1:]), "\t")
+	if key[0] == prefixes.Unary {
+		if len(ids) != 1 {
+			return nil, false
+		}
+
+		val := make([]byte, 24)
+		for p := Permutation(0); p < 6; p++ {
+			prefix := assembleKey(prefixes.Binary[p], true, ID(ids[0]))
+			binary.BigEndian.PutUint32(val[p*4:(p+1)*4], countKeys(prefix, txn))
+		}
+		return val, true
+	}
+
+	if len(ids) != 2 {
+		return nil, false
+	}
+
+	var p Permutation
+	for p = 0; p < 6 && prefixes.Binary[p] != key[0]; p++ {
+	}
+
+	// The binary keys of the first three permutations count the ternary keys with
+	// the same two leading terms. The last three skip a term, so their pairs are the
+	// last and first terms of another ternary permutation, in the opposite order.
+	a, b := ID(ids[0]), ID(ids[1])
+	prefix := assembleKey(prefixes.Ternary[p%3], true, a, b)
+	if p >= 3 {
+		prefix = assembleKey(prefixes.Ternary[(p-3+2)%3], true, b, a)
+	}
+
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, countKeys(prefix, txn))
+	return val, true
+}
+
+func countKeys(prefix []byte, txn *badger.Txn) (count uint32) {
+	iter := txn.NewIterator(badger.IteratorOptions{PrefetchValues: false, Prefix: prefix})
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		count++
+	}
+	return
+}